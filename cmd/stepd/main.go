@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,12 +10,19 @@ import (
 	"os"
 	"os/signal"
 	"runtime/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/colinrgodsey/serial"
+	"github.com/colinrgodsey/step-daemon/lib/config"
+	"github.com/colinrgodsey/step-daemon/lib/gcode"
 	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/physics"
 	"github.com/colinrgodsey/step-daemon/lib/pipeline"
+	"github.com/colinrgodsey/step-daemon/lib/sim"
 
 	"github.com/pkg/profile"
 )
@@ -22,6 +30,11 @@ import (
 const (
 	readBufferSize    = 24
 	normalPlannerSize = 8
+
+	minBackoff        = 500 * time.Millisecond
+	maxBackoff        = 30 * time.Second
+	resetBackoffAfter = time.Minute
+	shutdownTimeout   = 30 * time.Second
 )
 
 var (
@@ -30,26 +43,22 @@ var (
 	baud       int
 
 	addr    string
+	doSim   bool
 	doTrace bool
 	doProf  bool
-)
-
-func handler(head io.Conn, size int, h func(head, tail io.Conn)) (tail io.Conn) {
-	head = head.Flip()
-	tail = io.NewConn(size, size)
 
-	go h(head, tail)
-
-	return
-}
+	device   atomic.Value // current gio.ReadWriteCloser
+	exiting  int32
+	exitCode int32
+)
 
-func stepdPipeline(c io.Conn) io.Conn {
-	c = handler(c, normalPlannerSize, pipeline.SourceHandler)
-	c = handler(c, 1, pipeline.ConfigHandler(configPath))
-	c = handler(c, 1, pipeline.DeltaHandler)
-	c = handler(c, 1, pipeline.PhysicsHandler)
-	c = handler(c, pipeline.NumPages, pipeline.StepHandler)
-	c = handler(c, pipeline.MaxPendingCommands, pipeline.DeviceHandler)
+func stepdPipeline(sup *pipeline.Supervisor, c io.Conn) io.Conn {
+	c = sup.Start(c, normalPlannerSize, pipeline.SourceHandler)
+	c = sup.Start(c, 1, pipeline.ConfigHandler(configPath))
+	c = sup.Start(c, 1, pipeline.DeltaHandler)
+	c = sup.Start(c, 1, pipeline.PhysicsHandler)
+	c = sup.Start(c, pipeline.NumPages, pipeline.StepHandler)
+	c = sup.Start(c, pipeline.MaxPendingCommands, pipeline.DeviceHandler)
 	return c
 }
 
@@ -61,8 +70,16 @@ func main() {
 	flag.BoolVar(&doTrace, "trace", false, "Enable tracing (debug)")
 	flag.BoolVar(&doProf, "prof", false, "Enable profiling (debug)")
 	flag.StringVar(&addr, "addr", "", "Test UI address (debug)")
+	flag.BoolVar(&doSim, "sim", false, "Use a virtual device (debug)")
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "estimate":
+		os.Exit(estimate(flag.Args()[1:]))
+	case "export":
+		os.Exit(export(flag.Args()[1:]))
+	}
+
 	if doTrace {
 		trace.Start(os.Stderr)
 		defer trace.Stop()
@@ -78,47 +95,300 @@ func main() {
 		}()
 	}
 
+	if devicePath == "" && addr == "" && !doSim {
+		fmt.Println("Failed to start stepd: Need to provide either device and baud, addr, sim, estimate or export")
+		os.Exit(1)
+	}
+	if doSim {
+		if err := checkSimConfig(); err != nil {
+			fmt.Printf("Failed to start stepd: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	c := io.NewConn(32, 32)
-	go io.LinePipe(os.Stdin, os.Stdout, c.Flip())
-	c = stepdPipeline(c)
-	tailSink(c)
+	go io.LineReader(os.Stdin, c.Flip())
+	closeOnExit(c)
+	go tailSink(c)
+
+	// returns once the pipeline has drained after stdin closes, or faults
+	io.LineWriter(os.Stdout, c.Flip())
+	if dev, ok := device.Load().(gio.Closer); ok {
+		dev.Close()
+	}
+	os.Exit(int(atomic.LoadInt32(&exitCode)))
 }
 
-func closeOnExit(closer func()) {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+// closeOnExit closes the host input on the first signal, so the pipeline
+// drains and the device runs the pages it has before stepd exits. Another
+// signal, or the drain taking longer than shutdownTimeout, exits at once.
+func closeOnExit(c io.Conn) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		closer()
+		<-sig
+		atomic.StoreInt32(&exiting, 1)
+		go func() {
+			c.Flip().Write("info:closing device")
+			c.Close()
+		}()
+
+		select {
+		case <-sig:
+		case <-time.After(shutdownTimeout):
+		}
+		if dev, ok := device.Load().(gio.Closer); ok {
+			dev.Close()
+		}
+		os.Exit(1)
 	}()
 }
 
-//TODO: need the auto restart loop here
-func tailSink(c io.Conn) {
-	var tail gio.ReadWriteCloser
-	var err error
-
+func openDevice() (tail gio.ReadWriteCloser, err error) {
 	if devicePath != "" && baud != 0 {
 		cfg := &serial.Config{Name: devicePath, Baud: baud}
 		tail, err = serial.OpenPort(cfg)
-		closeOnExit(func() {
-			fmt.Println("info:closing device serial")
-			tail.Close()
-			time.Sleep(3000)
-		})
 	} else if addr != "" {
 		if tail, err = net.Dial("tcp", addr); err != nil {
 			err = fmt.Errorf("Failed to connect to %v: %w", addr, err)
 		}
+	} else if doSim {
+		var conf config.Config
+		if conf, err = config.LoadConfig(configPath); err == nil {
+			tail = sim.NewDevice(conf.Format, sim.DefaultSettings, false)
+		}
 	} else {
-		err = errors.New("Need to provide either device and baud, or addr")
+		err = errors.New("Need to provide either device and baud, addr, or sim")
 	}
+	return
+}
 
+// checkSimConfig rejects configs the virtual device can't run. It
+// reports positions from its step counts, which only works for
+// cartesian machines.
+func checkSimConfig() error {
+	conf, err := config.LoadConfig(configPath)
 	if err != nil {
-		err = fmt.Errorf("Failed to start stepd: %w", err)
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+	if conf.Kinematics != "" && conf.Kinematics != physics.KinematicsCartesian {
+		return fmt.Errorf("sim does not support %v kinematics", conf.Kinematics)
+	}
+	return nil
+}
+
+// unacked holds the host lines sent to a pipeline session that have not
+// been acked with an ok yet, oldest first.
+type unacked struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (u *unacked) push(line string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lines = append(u.lines, line)
+}
+
+func (u *unacked) ack() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.lines) > 0 {
+		u.lines = u.lines[1:]
 	}
+}
+
+// drop removes and returns all the unacked lines.
+func (u *unacked) drop() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	lines := u.lines
+	u.lines = nil
+	return lines
+}
+
+// isOk returns true if msg acks a host line.
+func isOk(msg io.Any) bool {
+	str, ok := msg.(string)
+	return ok && (str == "ok" || strings.HasPrefix(str, "ok N"))
+}
 
-	io.LinePipe(tail, tail, c)
+// forwardInput forwards host lines to a pipeline session, once the
+// session has started reading them. It runs separately from bridge, so
+// a blocked pipeline can't keep its responses from reaching upstream.
+func forwardInput(up, session io.Conn, sup *pipeline.Supervisor, started <-chan struct{},
+	inputClosed chan<- struct{}, pending *unacked) {
+	ctx := sup.Context()
+	up = up.Flip().WithContext(ctx)
+	session = session.WithContext(ctx)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-started:
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-up.Rc():
+			if io.IsClosed(msg) {
+				close(inputClosed)
+				session.Write(msg)
+				return
+			}
+			if str, ok := msg.(string); ok && pipeline.IsAcked(str) {
+				pending.push(str)
+			}
+			session.Write(msg)
+		}
+	}
+}
+
+// bridge forwards messages from a pipeline session to the upstream host.
+// The upstream conn outlives the session, and is only closed once the
+// session drains after the upstream input has closed.
+func bridge(up, session io.Conn, sup *pipeline.Supervisor, started chan<- struct{},
+	inputClosed <-chan struct{}, restart chan<- struct{}, pending *unacked) (finished bool) {
+	ctx := sup.Context()
+	up = up.Flip().WithContext(ctx)
+	session = session.WithContext(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sup.Done():
+			// forward the final error report
+			for len(session.Rc()) > 0 {
+				if msg, ok := (<-session.Rc()).(string); ok {
+					up.Write(msg)
+				}
+			}
+			return
+		case msg := <-session.Rc():
+			if _, ok := msg.(pipeline.DeviceRestart); ok {
+				close(restart)
+				return
+			} else if io.IsClosed(msg) {
+				select {
+				case <-inputClosed:
+					up.Close()
+					return true
+				default:
+					continue
+				}
+			} else if msg == pipeline.Initialized && started != nil {
+				close(started)
+				started = nil
+			} else if isOk(msg) {
+				pending.ack()
+			}
+			up.Write(msg)
+		}
+	}
+}
+
+// runSession opens the device and runs a fresh pipeline against it until
+// the device disconnects or restarts, or the pipeline finishes. Host lines
+// sent to the session but not acked are left in pending.
+func runSession(c io.Conn, pending *unacked) (opened, finished bool, err error) {
+	tail, err := openDevice()
+	if err != nil {
+		return
+	}
+	opened = true
+	device.Store(tail)
+
+	session := io.NewConn(32, 32)
+	sup := pipeline.NewSupervisor(context.Background())
+	started := make(chan struct{})
+	inputClosed := make(chan struct{})
+	restart := make(chan struct{})
+	bridged := make(chan bool, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		forwardInput(c, session, sup, started, inputClosed, pending)
+	}()
+	go func() {
+		defer wg.Done()
+		bridged <- bridge(c, session, sup, started, inputClosed, restart, pending)
+	}()
+
+	pipeErr := make(chan error, 1)
+	go func() {
+		pipeErr <- io.LinePipe(tail, tail, stepdPipeline(sup, session))
+	}()
+
+	select {
+	case err = <-pipeErr:
+	case <-restart:
+		err = errors.New("device restart detected")
+	case <-sup.Done():
+		<-bridged
+		err = sup.Err()
+	case finished = <-bridged:
+	}
+
+	sup.Stop()
+	tail.Close()
+	sup.Wait()
+	wg.Wait()
+	return
+}
+
+// dropLines answers each host line lost with a session with an error,
+// and the ok the host is waiting on.
+func dropLines(up io.Conn, lines []string) {
+	for _, line := range lines {
+		up.Write(fmt.Sprintf("error:line dropped on device reset (%v)", line))
+		if g, err := gcode.Parse(line); err == nil && g.Num != -1 {
+			up.Write(fmt.Sprintf("ok N%v", g.Num))
+		} else {
+			up.Write("ok")
+		}
+	}
+}
+
+// tailSink runs pipeline sessions against the device, reconnecting
+// with backoff whenever the device is lost or restarts.
+func tailSink(c io.Conn) {
+	up := c.Flip()
+	backoff := minBackoff
+	var pending unacked
+	for {
+		start := time.Now()
+		opened, finished, err := runSession(c, &pending)
+		if finished {
+			return
+		}
+		if _, ok := err.(*pipeline.Error); ok {
+			// fault was reported upstream
+			atomic.StoreInt32(&exitCode, 1)
+			up.Close()
+			return
+		}
+		switch {
+		case !opened:
+			up.Write(fmt.Sprintf("warn:failed to open device: %v", err))
+		case time.Since(start) > resetBackoffAfter:
+			backoff = minBackoff
+			fallthrough
+		default:
+			up.Write(fmt.Sprintf("warn:device reset (%v), restarting pipeline", err))
+		}
+		dropLines(up, pending.drop())
+		if atomic.LoadInt32(&exiting) == 1 {
+			up.Close()
+			return
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
 }
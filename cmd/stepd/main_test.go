@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/pipeline"
+)
+
+func TestSessionDroppedLines(t *testing.T) {
+	c := io.NewConn(32, 32)
+	session := io.NewConn(32, 32)
+	sup := pipeline.NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	var pending unacked
+	started := make(chan struct{})
+	inputClosed := make(chan struct{})
+	restart := make(chan struct{})
+	go forwardInput(c, session, sup, started, inputClosed, &pending)
+	go bridge(c, session, sup, started, inputClosed, restart, &pending)
+
+	read := func(conn io.Conn) io.Any {
+		select {
+		case msg := <-conn.Rc():
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+		return nil
+	}
+
+	dev := session.Flip()
+	c.Write("G28")
+	c.Write("; comment")
+	c.Write("N5 G1 X10")
+
+	// nothing is forwarded until the session has started
+	select {
+	case msg := <-dev.Rc():
+		t.Fatalf("Forwarded %v before start", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	dev.Write(pipeline.Initialized)
+	if msg := read(c); msg != pipeline.Initialized {
+		t.Fatalf("Expected %v, got %v", pipeline.Initialized, msg)
+	}
+	for _, exp := range []string{"G28", "; comment", "N5 G1 X10"} {
+		if msg := read(dev); msg != exp {
+			t.Fatalf("Expected %v, got %v", exp, msg)
+		}
+	}
+
+	dev.Write("ok")
+	if msg := read(c); msg != "ok" {
+		t.Fatalf("Expected ok, got %v", msg)
+	}
+	dev.Write(pipeline.DeviceRestart{})
+	select {
+	case <-restart:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	dropLines(c.Flip(), pending.drop())
+	exp := []string{"error:line dropped on device reset (N5 G1 X10)", "ok N5"}
+	var lines []string
+	for range exp {
+		lines = append(lines, fmt.Sprint(read(c)))
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(exp) {
+		t.Fatalf("Expected %q, got %q", exp, lines)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	gio "io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colinrgodsey/step-daemon/lib/config"
+	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/physics"
+	"github.com/colinrgodsey/step-daemon/lib/pipeline"
+	"github.com/colinrgodsey/step-daemon/lib/sim"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// offlinePipeline plans the motion without a device, see BlockHandler.
+func offlinePipeline(sup *pipeline.Supervisor, c io.Conn, settings []string, f func(pipeline.PlannedBlock)) {
+	c = sup.Start(c, normalPlannerSize, pipeline.SourceHandler)
+	c = sup.Start(c, 1, pipeline.ConfigHandler(configPath))
+	c = sup.Start(c, 1, pipeline.DeltaHandler)
+	c = sup.Start(c, 1, pipeline.PhysicsHandler)
+	sup.Start(c, 1, pipeline.BlockHandler(settings, f))
+}
+
+// offlineCmd is a command that plans a G-code file (or stdin)
+// without a device.
+type offlineCmd struct {
+	fs           *flag.FlagSet
+	settingsPath string
+}
+
+func newOfflineCmd(name string) *offlineCmd {
+	cmd := &offlineCmd{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	cmd.fs.StringVar(&configPath, "config", configPath, "Path to HJSON config file")
+	cmd.fs.StringVar(&cmd.settingsPath, "settings", "",
+		"Path to saved device settings (M503 response), defaults to the virtual device")
+	return cmd
+}
+
+/*
+plan runs the input through the planner, passing each planned block to f.
+The device settings come from a saved M503 response, or the virtual device
+defaults. Errors, and the fault that stopped the planner, are reported
+on stderr.
+*/
+func (cmd *offlineCmd) plan(f func(pipeline.PlannedBlock)) bool {
+	settings := sim.DefaultSettings
+	if cmd.settingsPath != "" {
+		var err error
+		if settings, err = sim.LoadSettings(cmd.settingsPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load settings: %v\n", err)
+			return false
+		}
+	}
+
+	var in gio.Reader = os.Stdin
+	if cmd.fs.NArg() > 0 {
+		file, err := os.Open(cmd.fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open %v: %v\n", cmd.fs.Arg(0), err)
+			return false
+		}
+		defer file.Close()
+		in = file
+	}
+
+	sup := pipeline.NewSupervisor(context.Background())
+	defer sup.Wait()
+	defer sup.Stop()
+
+	c := io.NewConn(32, 32)
+	offlinePipeline(sup, c, settings.Report(), f)
+	go io.LineReader(in, c.Flip())
+
+	for done := false; !done; {
+		select {
+		case msg := <-c.Rc():
+			if str, ok := msg.(string); ok && strings.HasPrefix(str, "error:") {
+				fmt.Fprintln(os.Stderr, str)
+			}
+			done = io.IsClosed(msg)
+		case <-sup.Done():
+			done = true
+		}
+	}
+	if err := sup.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err.String())
+		return false
+	}
+	return true
+}
+
+// estimate reports the print time and filament use of the planned motion.
+func estimate(args []string) int {
+	cmd := newOfflineCmd("estimate")
+	diameter := cmd.fs.Float64("filament", 1.75, "Filament diameter (mm)")
+	asJSON := cmd.fs.Bool("json", false, "Report as JSON")
+	cmd.fs.Parse(args)
+
+	var est pipeline.Estimate
+	if !cmd.plan(est.Add) {
+		return 1
+	}
+
+	volume := est.Filament * math.Pi * *diameter * *diameter / 4
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			*pipeline.Estimate
+			Volume float64 `json:"filament-volume"`
+		}{&est, volume})
+		return 0
+	}
+
+	duration := func(secs float64) time.Duration {
+		return time.Duration(secs * float64(time.Second)).Round(time.Second)
+	}
+	fmt.Printf("print time: %v\n", duration(est.Time))
+	fmt.Printf("filament: %.2fmm (%.2fcm3)\n", est.Filament, volume/1000)
+	fmt.Printf("blocks: %v (resized: %v, s-curve fallbacks: %v)\n",
+		est.Blocks, est.Resized, est.SCurveFallbacks)
+	fmt.Printf("layers: %v\n", len(est.Layers))
+	for i, l := range est.Layers {
+		fmt.Printf("  layer %v (z %.2f): %v\n", i+1, l.Z, duration(l.Time))
+	}
+	return 0
+}
+
+/*
+export writes the planned motion of each block, for plotting. CSV has a
+row per block, or a row per sample with -samples. JSON is a list of the
+blocks, each with its samples if enabled. Samples are taken before
+pressure advance and input shaping.
+*/
+func export(args []string) int {
+	cmd := newOfflineCmd("export")
+	format := cmd.fs.String("format", "csv", "Output format (csv or json)")
+	withSamples := cmd.fs.Bool("samples", false, "Include the sampled position, velocity and acceleration")
+	cmd.fs.Parse(args)
+
+	conf, err := config.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %v: %v\n", configPath, err)
+		return 1
+	}
+	sps := float64(conf.TicksPerSecond) / float64(config.GetPageFormat(conf.Format).SegmentSteps)
+
+	var w exportWriter
+	switch *format {
+	case "csv":
+		w = &csvExport{w: csv.NewWriter(os.Stdout), samples: *withSamples}
+	case "json":
+		w = &jsonExport{w: os.Stdout}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown export format %v\n", *format)
+		return 1
+	}
+
+	var start float64
+	n := 0
+	ok := cmd.plan(func(block pipeline.PlannedBlock) {
+		var samples []physics.BlockSample
+		if *withSamples {
+			samples = physics.SampleBlock(block.MotionBlock, sps)
+		}
+		info := physics.DescribeBlock(block.MotionBlock)
+		w.write(exportBlock{n, start, info, samples})
+		start += info.Time
+		n++
+	})
+	w.close()
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+type exportBlock struct {
+	Block int     `json:"block"`
+	Start float64 `json:"start-time"`
+	physics.BlockInfo
+	Samples []physics.BlockSample `json:"samples,omitempty"`
+}
+
+type exportWriter interface {
+	write(b exportBlock)
+	close()
+}
+
+type jsonExport struct {
+	w     gio.Writer
+	count int
+}
+
+func (e *jsonExport) write(b exportBlock) {
+	sep := ",\n"
+	if e.count == 0 {
+		sep = "[\n"
+	}
+	e.count++
+	bytes, _ := json.Marshal(b)
+	fmt.Fprintf(e.w, "%v%s", sep, bytes)
+}
+
+func (e *jsonExport) close() {
+	if e.count == 0 {
+		fmt.Fprint(e.w, "[")
+	}
+	fmt.Fprintln(e.w, "\n]")
+}
+
+type csvExport struct {
+	w       *csv.Writer
+	samples bool
+	header  bool
+}
+
+func (e *csvExport) write(b exportBlock) {
+	f := func(x float64) string {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	v := func(v vec.Vec4) []string {
+		return []string{f(v.X()), f(v.Y()), f(v.Z()), f(v.E())}
+	}
+	axes := func(prefix string) []string {
+		return []string{prefix + "x", prefix + "y", prefix + "z", prefix + "e"}
+	}
+	join := func(parts ...[]string) (res []string) {
+		for _, p := range parts {
+			res = append(res, p...)
+		}
+		return
+	}
+
+	if e.samples {
+		if !e.header {
+			e.w.Write(join([]string{"block", "time"}, axes(""), axes("v"), axes("a")))
+			e.header = true
+		}
+		for _, s := range b.Samples {
+			e.w.Write(join([]string{strconv.Itoa(b.Block), f(b.Start + s.Time)},
+				v(s.Pos), v(s.Vel), v(s.Acc)))
+		}
+		return
+	}
+
+	if !e.header {
+		e.w.Write(join([]string{"block", "start_time", "type"}, axes("from_"), axes("to_"),
+			[]string{"fr_start", "fr_cruise", "fr_end", "accel_time", "cruise_time", "decel_time", "time"}))
+		e.header = true
+	}
+	e.w.Write(join([]string{strconv.Itoa(b.Block), f(b.Start), b.Type}, v(b.From), v(b.To),
+		[]string{f(b.FrStart), f(b.FrCruise), f(b.FrEnd), f(b.Accel), f(b.Cruise), f(b.Decel), f(b.Time)}))
+}
+
+func (e *csvExport) close() {
+	e.w.Flush()
+}
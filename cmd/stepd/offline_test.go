@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/colinrgodsey/step-daemon/lib/physics"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+var testExportBlock = exportBlock{
+	Block: 2,
+	Start: 1.5,
+	BlockInfo: physics.BlockInfo{
+		Type:     physics.BlockTrap,
+		From:     vec.NewVec4(0, 0, 0, 0),
+		To:       vec.NewVec4(10, 5, 0, 1),
+		FrStart:  0,
+		FrCruise: 100,
+		FrEnd:    20,
+		Accel:    0.1,
+		Cruise:   0.05,
+		Decel:    0.08,
+		Time:     0.23,
+	},
+	Samples: []physics.BlockSample{{
+		Time: 0.01,
+		Pos:  vec.NewVec4(0.05, 0.025, 0, 0.005),
+		Vel:  vec.NewVec4(8, 4, 0, 0.8),
+		Acc:  vec.NewVec4(800, 400, 0, 80),
+	}},
+}
+
+func readCSV(t *testing.T, samples bool) [][]string {
+	var buf bytes.Buffer
+	w := &csvExport{w: csv.NewWriter(&buf), samples: samples}
+	w.write(testExportBlock)
+	w.close()
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestExportCSV(t *testing.T) {
+	exp := [][]string{
+		{"block", "start_time", "type", "from_x", "from_y", "from_z", "from_e", "to_x", "to_y", "to_z", "to_e",
+			"fr_start", "fr_cruise", "fr_end", "accel_time", "cruise_time", "decel_time", "time"},
+		{"2", "1.5", "trap", "0", "0", "0", "0", "10", "5", "0", "1",
+			"0", "100", "20", "0.1", "0.05", "0.08", "0.23"},
+	}
+	if rows := readCSV(t, false); fmt.Sprint(rows) != fmt.Sprint(exp) {
+		t.Fatalf("Expected blocks %v, got %v", exp, rows)
+	}
+
+	exp = [][]string{
+		{"block", "time", "x", "y", "z", "e", "vx", "vy", "vz", "ve", "ax", "ay", "az", "ae"},
+		{"2", "1.51", "0.05", "0.025", "0", "0.005", "8", "4", "0", "0.8", "800", "400", "0", "80"},
+	}
+	if rows := readCSV(t, true); fmt.Sprint(rows) != fmt.Sprint(exp) {
+		t.Fatalf("Expected samples %v, got %v", exp, rows)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	w := &jsonExport{w: &buf}
+	w.write(testExportBlock)
+	w.write(testExportBlock)
+	w.close()
+
+	var blocks []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &blocks); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %v", len(blocks))
+	}
+
+	exp := map[string]interface{}{
+		"block": 2.0, "start-time": 1.5, "type": "trap",
+		"fr-start": 0.0, "fr-cruise": 100.0, "fr-end": 20.0,
+		"accel-time": 0.1, "cruise-time": 0.05, "decel-time": 0.08, "time": 0.23,
+	}
+	b := blocks[0]
+	for k, v := range exp {
+		if b[k] != v {
+			t.Fatalf("Expected %v to be %v, got %v", k, v, b[k])
+		}
+	}
+	for _, k := range []string{"from", "to", "samples"} {
+		if _, ok := b[k]; !ok {
+			t.Fatalf("Missing %v in %v", k, b)
+		}
+	}
+	samples := b["samples"].([]interface{})
+	if s := samples[0].(map[string]interface{}); s["time"] != 0.01 || s["pos"] == nil || s["vel"] == nil || s["acc"] == nil {
+		t.Fatalf("Unexpected sample %v", s)
+	}
+
+	// no blocks is still a list
+	buf.Reset()
+	w = &jsonExport{w: &buf}
+	w.close()
+	if err := json.Unmarshal(buf.Bytes(), &blocks); err != nil || len(blocks) != 0 {
+		t.Fatalf("Expected an empty list, got %q", buf.String())
+	}
+}
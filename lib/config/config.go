@@ -10,12 +10,48 @@ import (
 	"github.com/hjson/hjson-go"
 )
 
+// Cornering models used to find junction speeds.
+const (
+	CorneringDot               = "dot"
+	CorneringJunctionDeviation = "junction-deviation"
+)
+
+// Shaper configures the input shaper of an axis.
+type Shaper struct {
+	Type    string  `json:"type"`
+	Freq    float64 `json:"freq"`
+	Damping float64 `json:"damping"`
+}
+
+// Delta configures the geometry of a linear delta, see M665 and M666.
+type Delta struct {
+	Radius         float64    `json:"radius"`
+	DiagonalRod    float64    `json:"diagonal-rod"`
+	TowerAngleTrim [3]float64 `json:"tower-angle-trim"`
+	EndstopOffsets [3]float64 `json:"endstop-offsets"`
+}
+
 type Config struct {
 	SJerk          vec.Vec4 `json:"s-jerk"`
 	TicksPerSecond int      `json:"ticks-per-second"`
 	Format         string   `json:"format"`
 	BedMax         f64.Vec2 `json:"bed-max"`
 	BedSamplesPath string   `json:"bed-samples-path"`
+	Lookahead      int      `json:"lookahead"`
+	Kinematics     string   `json:"kinematics"`
+	Delta          Delta    `json:"delta"`
+
+	ArcTolerance float64 `json:"arc-tolerance"`
+	DwellPages   bool    `json:"dwell-pages"`
+
+	Cornering         string  `json:"cornering"`
+	JunctionDeviation float64 `json:"junction-deviation"`
+
+	ShaperX Shaper `json:"shaper-x"`
+	ShaperY Shaper `json:"shaper-y"`
+
+	AdvanceWindow     string  `json:"pressure-advance-window"`
+	AdvanceSmoothTime float64 `json:"pressure-advance-smooth-time"`
 }
 
 func LoadConfig(path string) (conf Config, err error) {
@@ -33,6 +33,16 @@ func (a Args) GetString(f rune) (x string, ok bool) {
 	return
 }
 
+// Has returns true if the arg label is present, with or without a value.
+func (a Args) Has(f rune) bool {
+	for _, str := range a {
+		if len(str) > 0 && rune(str[0]) == f {
+			return true
+		}
+	}
+	return false
+}
+
 // GetInt for an arg label
 func (a Args) GetInt(f rune) (x int, ok bool) {
 	var str string
@@ -14,13 +14,14 @@ type GCode struct {
 	CommandCode int
 	Num         int
 	Args        Args
+	SubCode     int // as in G59.1, 0 if not given
 }
 
 // ErrChecksumBad is returned for bad gcode checksums
 var ErrChecksumBad = errors.New("gcode: Bad Checksum")
 
 func New(typ rune, code int, args ...string) GCode {
-	return GCode{typ, code, -1, args}
+	return GCode{typ, code, -1, args, 0}
 }
 
 // Parse creates a GCode from a string
@@ -65,10 +66,16 @@ func Parse(line string) (g GCode, err error) {
 		return
 	}
 	g.CommandType = rune(cmd[0])
-	g.CommandCode, err = strconv.Atoi(string(cmd[1:]))
+	code := strings.SplitN(cmd[1:], ".", 2)
+	g.CommandCode, err = strconv.Atoi(code[0])
 	if err != nil {
 		return
 	}
+	if len(code) > 1 {
+		if g.SubCode, err = strconv.Atoi(code[1]); err != nil {
+			return
+		}
+	}
 
 	spl = strings.Split(line, " ")
 	g.Args = make([]string, 0, len(spl)-1)
@@ -82,16 +89,20 @@ func Parse(line string) (g GCode, err error) {
 	return
 }
 
+// command returns the command, such as G1 or G59.1.
+func (g GCode) command() string {
+	if g.SubCode != 0 {
+		return fmt.Sprintf("%v%v.%v", string(g.CommandType), g.CommandCode, g.SubCode)
+	}
+	return fmt.Sprintf("%v%v", string(g.CommandType), g.CommandCode)
+}
+
 func (g GCode) String() string {
 	if g.Num == -1 {
-		str := fmt.Sprintf("%v%v %v",
-			string(g.CommandType),
-			g.CommandCode, g.Args)
+		str := fmt.Sprintf("%v %v", g.command(), g.Args)
 		return strings.TrimSpace(str)
 	}
-	str := fmt.Sprintf("N%v %v%v %v",
-		g.Num, string(g.CommandType),
-		g.CommandCode, g.Args)
+	str := fmt.Sprintf("N%v %v %v", g.Num, g.command(), g.Args)
 	str = strings.TrimSpace(str)
 
 	var chs byte
@@ -102,9 +113,14 @@ func (g GCode) String() string {
 }
 
 func (g GCode) IsG(code int) bool {
-	return g.CommandType == 'G' && g.CommandCode == code
+	return g.IsGSub(code, 0)
+}
+
+// IsGSub returns true for the G-code with a subcode, such as G59.1.
+func (g GCode) IsGSub(code, sub int) bool {
+	return g.CommandType == 'G' && g.CommandCode == code && g.SubCode == sub
 }
 
 func (g GCode) IsM(code int) bool {
-	return g.CommandType == 'M' && g.CommandCode == code
+	return g.CommandType == 'M' && g.CommandCode == code && g.SubCode == 0
 }
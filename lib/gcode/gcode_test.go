@@ -27,6 +27,22 @@ func TestIs(t *testing.T) {
 	}
 }
 
+func TestSubCode(t *testing.T) {
+	g, err := Parse("N12 G59.1 X1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.IsGSub(59, 1) || g.IsG(59) {
+		t.Fatalf("Failed to parse subcode %v", g)
+	}
+	if g.String() != "N12 G59.1 X1*112" {
+		t.Fatalf("Failed to recreate gcode string: %v", g)
+	}
+	if _, err := Parse("G92.X"); err == nil {
+		t.Fatal("Should fail to parse a bad subcode")
+	}
+}
+
 func TestSingle(t *testing.T) {
 	testCommands := [...]string{
 		"M107",
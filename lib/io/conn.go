@@ -1,15 +1,23 @@
 package io
 
+import "context"
+
 type Any interface{}
 
+// closeMsg marks the end of a stream. It is sent as a message instead of
+// closing the channel, so Close is safe with multiple writers.
+type closeMsg struct{}
+
 // Conn is a generic bidirectional IO stream. Can be flipped to use
 // a tail Conn as the head Conn for the next handler or vice versa.
 type Conn struct {
-	rd chan Any
-	wr chan Any
+	rd   chan Any
+	wr   chan Any
+	done <-chan struct{}
 }
 
-// Rc returns the read channel for this Conn
+// Rc returns the read channel for this Conn. Use IsClosed to check
+// for the end of the stream when reading from it directly.
 func (c Conn) Rc() <-chan Any {
 	return c.rd
 }
@@ -19,14 +27,53 @@ func (c Conn) Wc() chan<- Any {
 	return c.wr
 }
 
-// Write is a convenience function for c.Wc() <- msg
+// Done returns the Done channel of the bound context, or nil.
+func (c Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Write is a convenience function for c.Wc() <- msg. The write
+// is abandoned if the bound context is done.
 func (c Conn) Write(msg Any) {
-	c.Wc() <- msg
+	select {
+	case c.Wc() <- msg:
+	case <-c.done:
+	}
+}
+
+// Read the next message. ok is false at the end of the stream,
+// or if the bound context is done.
+func (c Conn) Read() (msg Any, ok bool) {
+	select {
+	case msg = <-c.Rc():
+		ok = !IsClosed(msg)
+	case <-c.done:
+	}
+	return
+}
+
+// Close signals the end of the stream to the reader. Anything
+// written after Close is ignored by Read.
+func (c Conn) Close() {
+	c.Write(closeMsg{})
+}
+
+// IsClosed returns true if msg marks the end of the stream.
+func IsClosed(msg Any) bool {
+	_, ok := msg.(closeMsg)
+	return ok
+}
+
+// WithContext binds the Conn to ctx. Reads and writes on the
+// returned Conn stop blocking once ctx is done.
+func (c Conn) WithContext(ctx context.Context) Conn {
+	c.done = ctx.Done()
+	return c
 }
 
 // Flip the Conn to convert a tail Conn to a head Conn
 func (c Conn) Flip() Conn {
-	return Conn{rd: c.wr, wr: c.rd}
+	return Conn{rd: c.wr, wr: c.rd, done: c.done}
 }
 
 // NewConn creates a new Conn with the desired chan buffer size.
@@ -26,6 +26,7 @@ const (
 // that use a line based text protocol with a binary
 // control protocol signaled by the ControlChar.
 // Only capable of reading 'response' format control data.
+// Returns the first error once the reader fails.
 func LinePipe(reader io.Reader, writer io.Writer, c Conn) error {
 	err := make(chan error, 4)
 	stopWrite := make(chan struct{})
@@ -36,77 +37,99 @@ func LinePipe(reader io.Reader, writer io.Writer, c Conn) error {
 	go func() {
 		defer wg.Done()
 		defer close(stopWrite)
-
-		reader := bufio.NewReader(reader)
-		for {
-			pb, lerr := reader.Peek(1)
-
-			switch {
-			case lerr != nil:
-				err <- lerr
-				return
-			case pb[0] == ControlChar:
-				bytes := make([]byte, 0, ControlLineLength)
-				reader.ReadByte() // discard control char
-				for i := 0; i < ControlLineLength; i++ {
-					b, lerr := reader.ReadByte()
-					if lerr != nil {
-						err <- lerr
-						return
-					}
-					bytes = append(bytes, b)
-				}
-				c.rd <- bytes
-			default:
-				str, lerr := reader.ReadString(endLine)
-				str = strings.TrimSpace(str)
-				switch {
-				case lerr != nil:
-					err <- lerr
-					return
-				case str == "": // ignore empty lines
-				default:
-					c.rd <- str
-				}
-			}
-		}
+		err <- readLines(reader, c)
 	}()
 
 	go func() {
 		defer wg.Done()
+		if lerr := writeLines(writer, c, stopWrite); lerr != nil {
+			err <- lerr
+		}
+	}()
 
-		writer := bufio.NewWriter(writer)
-		for {
-			var data Any
-			select {
-			case <-stopWrite:
-				return
-			case data = <-c.wr:
-			}
+	wg.Wait()
+	return <-err // return first error
+}
 
-			switch v := data.(type) {
-			case []byte:
-				bytes := make([]byte, 0, len(v)+2)
-				bytes = append(bytes, ControlChar)
-				bytes = append(bytes, v...)
-				bytes = append(bytes, endLine)
-				if _, lerr := writer.Write(bytes); lerr != nil {
-					err <- lerr
-					return
-				}
-			case string:
-				str := strings.TrimSpace(v) + string(endLine)
-				if _, lerr := writer.WriteString(str); lerr != nil {
-					err <- lerr
-					return
+// LineReader is the read half of LinePipe. The end of the
+// stream is signaled with Close once the reader fails.
+func LineReader(reader io.Reader, c Conn) error {
+	err := readLines(reader, c)
+	c.Flip().Close()
+	return err
+}
+
+// LineWriter is the write half of LinePipe. Returns nil once
+// Close is called on the write channel.
+func LineWriter(writer io.Writer, c Conn) error {
+	return writeLines(writer, c, nil)
+}
+
+func readLines(reader io.Reader, c Conn) error {
+	rd := c.Flip()
+	br := bufio.NewReader(reader)
+	for {
+		pb, err := br.Peek(1)
+
+		switch {
+		case err != nil:
+			return err
+		case pb[0] == ControlChar:
+			bytes := make([]byte, 0, ControlLineLength)
+			br.ReadByte() // discard control char
+			for i := 0; i < ControlLineLength; i++ {
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
 				}
+				bytes = append(bytes, b)
+			}
+			rd.Write(bytes)
+		default:
+			str, err := br.ReadString(endLine)
+			str = strings.TrimSpace(str)
+			switch {
+			case err != nil:
+				return err
+			case str == "": // ignore empty lines
 			default:
-				panic(fmt.Sprintf("Unknown value passed to in channel: %v", data))
+				rd.Write(str)
 			}
-			writer.Flush()
 		}
-	}()
+	}
+}
 
-	wg.Wait()
-	return <-err // return first error
+func writeLines(writer io.Writer, c Conn, stop <-chan struct{}) error {
+	bw := bufio.NewWriter(writer)
+	for {
+		var data Any
+		select {
+		case <-stop:
+			return nil
+		case <-c.done:
+			return nil
+		case data = <-c.wr:
+		}
+
+		switch v := data.(type) {
+		case []byte:
+			bytes := make([]byte, 0, len(v)+2)
+			bytes = append(bytes, ControlChar)
+			bytes = append(bytes, v...)
+			bytes = append(bytes, endLine)
+			if _, err := bw.Write(bytes); err != nil {
+				return err
+			}
+		case string:
+			str := strings.TrimSpace(v) + string(endLine)
+			if _, err := bw.WriteString(str); err != nil {
+				return err
+			}
+		case closeMsg:
+			return nil
+		default:
+			panic(fmt.Sprintf("Unknown value passed to in channel: %v", data))
+		}
+		bw.Flush()
+	}
 }
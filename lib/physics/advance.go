@@ -0,0 +1,142 @@
+package physics
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// Smoothing windows used for pressure advance.
+const (
+	WindowTriangle = "triangle"
+	WindowBox      = "box"
+)
+
+// boxFilter is a running average over a fixed number of samples.
+type boxFilter struct {
+	ring []float64
+	idx  int
+	sum  float64
+}
+
+func newBoxFilter(n int) *boxFilter {
+	return &boxFilter{ring: make([]float64, n)}
+}
+
+func (f *boxFilter) push(x float64) float64 {
+	f.sum += x - f.ring[f.idx]
+	f.ring[f.idx] = x
+	f.idx = (f.idx + 1) % len(f.ring)
+	return f.sum / float64(len(f.ring))
+}
+
+func (f *boxFilter) reset() {
+	for i := range f.ring {
+		f.ring[i] = 0
+	}
+	f.sum = 0
+}
+
+/*
+PressureAdvance adds a pressure advance term to the E axis of a position
+stream sampled at a fixed rate. The term is K times the extruder velocity
+of print moves, and is smoothed over a centered window of smoothTime, so it
+stays continuous across block boundaries and when starting or stopping
+extrusion. The whole stream is delayed by half the window to keep the
+window centered.
+*/
+type PressureAdvance struct {
+	k, sps float64
+
+	boxes []*boxFilter
+	delay []vec.Vec4 // ring of previous inputs
+	idx   int
+	quiet int // number of samples without motion
+}
+
+// NewPressureAdvance creates a pressure advance filter starting from pos.
+func NewPressureAdvance(k, smoothTime float64, window string,
+	samplesPerSecond float64, pos vec.Vec4) (*PressureAdvance, error) {
+	// odd lengths keep the delay a whole number of samples
+	odd := func(x float64) int {
+		return int(math.Max(x, 1)-1)/2*2 + 1
+	}
+
+	p := &PressureAdvance{k: k, sps: samplesPerSecond}
+	n := smoothTime * samplesPerSecond
+	switch window {
+	case "", WindowTriangle: // 2 boxes make a triangle
+		p.boxes = []*boxFilter{newBoxFilter(odd(n / 2)), newBoxFilter(odd(n / 2))}
+	case WindowBox:
+		p.boxes = []*boxFilter{newBoxFilter(odd(n))}
+	default:
+		return nil, fmt.Errorf("unknown pressure advance window %v", window)
+	}
+
+	d := 0
+	for _, b := range p.boxes {
+		d += (len(b.ring) - 1) / 2
+	}
+	p.delay = make([]vec.Vec4, d+1)
+	p.Reset(pos)
+	return p, nil
+}
+
+// Reset the filter to a resting pos.
+func (p *PressureAdvance) Reset(pos vec.Vec4) {
+	for i := range p.delay {
+		p.delay[i] = pos
+	}
+	for _, b := range p.boxes {
+		b.reset()
+	}
+	p.quiet = p.settleLen()
+}
+
+// settleLen is the number of samples needed for a change to pass through.
+func (p *PressureAdvance) settleLen() int {
+	n := len(p.delay)
+	for _, b := range p.boxes {
+		n += len(b.ring)
+	}
+	return n
+}
+
+// Push the next sample, and get the advanced sample.
+func (p *PressureAdvance) Push(pos vec.Vec4, isPrint bool) vec.Vec4 {
+	last := p.at(0)
+	p.idx = (p.idx + 1) % len(p.delay)
+	p.delay[p.idx] = pos
+	out := p.at(len(p.delay) - 1) // centered on the window
+
+	var adv float64
+	if isPrint {
+		adv = p.k * (pos.E() - last.E()) * p.sps
+	}
+	for _, b := range p.boxes {
+		adv = b.push(adv)
+	}
+
+	if pos.Eq(last) {
+		p.quiet++
+	} else {
+		p.quiet = 0
+	}
+	return out.Add(vec.NewVec4(0, 0, 0, adv))
+}
+
+// at returns the input from n samples ago.
+func (p *PressureAdvance) at(n int) vec.Vec4 {
+	return p.delay[(p.idx-n+len(p.delay))%len(p.delay)]
+}
+
+// Drain holds the last position until the output comes to rest
+// there, passing each advanced sample to emit.
+func (p *PressureAdvance) Drain(emit func(vec.Vec4)) {
+	last := p.at(0)
+	for p.quiet < p.settleLen() {
+		emit(p.Push(last, false))
+	}
+	p.Reset(last) // clear any drift in the running sums
+}
@@ -0,0 +1,51 @@
+package physics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+func TestPressureAdvance(t *testing.T) {
+	const (
+		sps = 20480.0
+		k   = 0.05
+		vE  = 2.0 // mm/s
+	)
+
+	for _, window := range []string{WindowTriangle, WindowBox} {
+		p, err := NewPressureAdvance(k, 0.04, window, sps, vec.Vec4{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// extrude at a constant rate, then stop dead
+		var pos, out vec.Vec4
+		maxStep := 0.0
+		emit := func(next vec.Vec4) {
+			maxStep = math.Max(maxStep, math.Abs(next.E()-out.E()))
+			out = next
+		}
+		for i := 0; i < int(sps/2); i++ {
+			pos = vec.NewVec4(float64(i)/sps, 0, 0, float64(i)*vE/sps)
+			emit(p.Push(pos, true))
+		}
+		if adv := out.E() - (pos.E() - vE*float64(len(p.delay)-1)/sps); math.Abs(adv-k*vE) > 1e-9 {
+			t.Fatalf("%v: expected steady advance of %v, got %v", window, k*vE, adv)
+		}
+		p.Drain(emit)
+
+		if math.Abs(out.E()-pos.E()) > 1e-9 {
+			t.Fatalf("%v: did not come to rest at %v (%v)", window, pos.E(), out.E())
+		}
+		// the raw advance would jump k*vE in a single sample
+		if maxStep > 5*vE/sps {
+			t.Fatalf("%v: E moved %v in a single sample", window, maxStep)
+		}
+	}
+
+	if _, err := NewPressureAdvance(0.05, 0.04, "foo", 1000, vec.Vec4{}); err == nil {
+		t.Fatal("Expected error for unknown window")
+	}
+}
@@ -0,0 +1,96 @@
+package physics
+
+import (
+	"errors"
+	"math"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// ArcPlane is the plane of an arc, as the indexes of its first and
+// second axis, and the axis of its helix.
+type ArcPlane [3]int
+
+// Planes selected with G17, G18 and G19.
+var (
+	PlaneXY = ArcPlane{0, 1, 2}
+	PlaneZX = ArcPlane{2, 0, 1}
+	PlaneYZ = ArcPlane{1, 2, 0}
+)
+
+// ErrArcRadius is returned if an arc radius is too small for its end points.
+var ErrArcRadius = errors.New("arc radius too small to reach the end point")
+
+/*
+ArcCenter finds the center of an arc from its radius, as given with G2/G3 R.
+Of the two arcs with that radius, a positive radius selects the arc of up to
+180 degrees, and a negative radius the longer arc.
+*/
+func ArcCenter(from, to vec.Vec4, r float64, plane ArcPlane, cw bool) (vec.Vec4, error) {
+	p, q := plane[0], plane[1]
+	dp, dq := to.GetAt(p)-from.GetAt(p), to.GetAt(q)-from.GetAt(q)
+	d := math.Hypot(dp, dq)
+	if d == 0 || r*r < d*d/4 {
+		return vec.Vec4{}, ErrArcRadius
+	}
+
+	// distance of the center from the middle of the chord, to its left
+	h := math.Sqrt(r*r - d*d/4)
+	if cw != (r < 0) {
+		h = -h
+	}
+	var c [4]float64
+	c[p] = (from.GetAt(p)+to.GetAt(p))/2 - dq/d*h
+	c[q] = (from.GetAt(q)+to.GetAt(q))/2 + dp/d*h
+	return vec.NewVec4(c[:]...), nil
+}
+
+/*
+Arc splits an arc into chords, and returns the end point of each chord.
+The arc runs around the center in the plane, from one position to another.
+Start and end points at the same angle make a full circle.
+The helix axis and E travel linearly with the angle, as does the radius if
+the end point is not exactly on the circle.
+
+The chords deviate at most tolerance from the arc.
+*/
+func Arc(from, to, center vec.Vec4, plane ArcPlane, cw bool, tolerance float64) []vec.Vec4 {
+	p, q, l := plane[0], plane[1], plane[2]
+	p0, q0 := from.GetAt(p)-center.GetAt(p), from.GetAt(q)-center.GetAt(q)
+	p1, q1 := to.GetAt(p)-center.GetAt(p), to.GetAt(q)-center.GetAt(q)
+	r0, r1 := math.Hypot(p0, q0), math.Hypot(p1, q1)
+
+	angle := math.Atan2(p0*q1-q0*p1, p0*p1+q0*q1)
+	if cw && angle >= 0 {
+		angle -= 2 * math.Pi
+	} else if !cw && angle <= 0 {
+		angle += 2 * math.Pi
+	}
+
+	// angle of each chord, to stay within the tolerance
+	r := math.Max(r0, r1)
+	step := math.Pi / 2
+	if tolerance < r {
+		step = math.Min(step, 2*math.Acos(1-tolerance/r))
+	}
+	n := int(math.Ceil(math.Abs(angle) / step))
+	if n < 1 {
+		n = 1
+	}
+
+	start := math.Atan2(q0, p0)
+	points := make([]vec.Vec4, n)
+	for i := 1; i < n; i++ {
+		f := float64(i) / float64(n)
+		a, r := start+angle*f, r0+(r1-r0)*f
+
+		var pos [4]float64
+		pos[p] = center.GetAt(p) + r*math.Cos(a)
+		pos[q] = center.GetAt(q) + r*math.Sin(a)
+		pos[l] = from.GetAt(l) + (to.GetAt(l)-from.GetAt(l))*f
+		pos[3] = from.E() + (to.E()-from.E())*f
+		points[i-1] = vec.NewVec4(pos[:]...)
+	}
+	points[n-1] = to
+	return points
+}
@@ -0,0 +1,102 @@
+package physics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// checkArc checks that each chord of the arc stays within the tolerance,
+// and that the arc turns through the expected angle.
+func checkArc(t *testing.T, from vec.Vec4, points []vec.Vec4, center vec.Vec4, plane ArcPlane, r, angle, tol float64) {
+	p, q := plane[0], plane[1]
+	polar := func(pos vec.Vec4) (float64, float64) {
+		dp, dq := pos.GetAt(p)-center.GetAt(p), pos.GetAt(q)-center.GetAt(q)
+		return math.Hypot(dp, dq), math.Atan2(dq, dp)
+	}
+
+	total := 0.0
+	pre := from
+	for _, pos := range points {
+		r0, a0 := polar(pre)
+		r1, a1 := polar(pos)
+		if math.Abs(r0-r)+math.Abs(r1-r) > 1e-9 {
+			t.Fatalf("chord from %v to %v is off the circle", pre, pos)
+		}
+		if mid, _ := polar(pre.Add(pos).Mul(0.5)); r-mid > tol+1e-9 {
+			t.Fatalf("chord from %v to %v deviates %v", pre, pos, r-mid)
+		}
+		da := math.Remainder(a1-a0, 2*math.Pi)
+		if math.Abs(da) > math.Pi/2+1e-9 {
+			t.Fatalf("chord from %v to %v is too long", pre, pos)
+		}
+		total += da
+		pre = pos
+	}
+	if math.Abs(total-angle) > 1e-9 {
+		t.Fatalf("expected the arc to turn %v, got %v", angle, total)
+	}
+}
+
+func TestArc(t *testing.T) {
+	const tol = 0.01
+	origin := vec.NewVec4(0, 0, 0, 0)
+	from := vec.NewVec4(10, 0, 0, 0)
+
+	// quarter circles, each way
+	to := vec.NewVec4(0, 10, 0, 0)
+	checkArc(t, from, Arc(from, to, origin, PlaneXY, false, tol), origin, PlaneXY, 10, math.Pi/2, tol)
+	checkArc(t, from, Arc(from, to, origin, PlaneXY, true, tol), origin, PlaneXY, 10, -3*math.Pi/2, tol)
+
+	// full circle
+	points := Arc(from, from, origin, PlaneXY, true, tol)
+	checkArc(t, from, points, origin, PlaneXY, 10, -2*math.Pi, tol)
+	if !points[len(points)-1].Eq(from) {
+		t.Fatalf("full circle should end at the start: %v", points[len(points)-1])
+	}
+
+	// helix in the YZ plane, with X and E moving along the arc
+	from = vec.NewVec4(0, 5, 0, 0)
+	to = vec.NewVec4(4, -5, 0, 2)
+	points = Arc(from, to, origin, PlaneYZ, false, tol)
+	checkArc(t, from, points, origin, PlaneYZ, 5, math.Pi, tol)
+	for i, pos := range points {
+		f := float64(i+1) / float64(len(points))
+		if math.Abs(pos.X()-4*f) > 1e-9 || math.Abs(pos.E()-2*f) > 1e-9 {
+			t.Fatalf("helix should move linearly, got %v at %v", pos, f)
+		}
+	}
+}
+
+func TestArcCenter(t *testing.T) {
+	from, to := vec.NewVec4(0, 0, 0, 0), vec.NewVec4(10, 0, 0, 0)
+	tests := []struct {
+		r      float64
+		cw     bool
+		center vec.Vec4
+	}{
+		{5, false, vec.NewVec4(5, 0, 0, 0)},
+		{10, false, vec.NewVec4(5, math.Sqrt(75), 0, 0)},
+		{10, true, vec.NewVec4(5, -math.Sqrt(75), 0, 0)},
+		{-10, false, vec.NewVec4(5, -math.Sqrt(75), 0, 0)}, // long way round
+	}
+	for _, test := range tests {
+		c, err := ArcCenter(from, to, test.r, PlaneXY, test.cw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Sub(test.center).Abs().Within(vec.NewVec4(Eps, Eps, Eps, Eps)) {
+			t.Fatalf("R%v: expected center %v, got %v", test.r, test.center, c)
+		}
+	}
+	if _, err := ArcCenter(from, to, 4, PlaneXY, false); err != ErrArcRadius {
+		t.Fatalf("expected a radius error, got %v", err)
+	}
+
+	// ZX plane, with the center to the left of Z
+	c, _ := ArcCenter(from, vec.NewVec4(0, 0, 10, 0), 5, PlaneZX, false)
+	if !c.Sub(vec.NewVec4(0, 0, 5, 0)).Abs().Within(vec.NewVec4(Eps, Eps, Eps, Eps)) {
+		t.Fatalf("bad ZX center %v", c)
+	}
+}
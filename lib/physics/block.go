@@ -6,8 +6,6 @@ import (
 	"github.com/colinrgodsey/step-daemon/lib/vec"
 )
 
-const iteratorChanCap = 64
-
 var (
 	// ErrEaseLimitPre is returned when the block has invalid start physics
 	ErrEaseLimitPre = errors.New("EaseLimitPre")
@@ -47,29 +45,31 @@ func (b trapBlock) GetMove() Move {
 	return b.move
 }
 
+// pulseBlock is a trapBlock with a single pulse, see PulseBlock.
+type pulseBlock struct {
+	shape Shape
+	move  Move
+}
+
+func (b pulseBlock) GetShape() Shape {
+	return b.shape
+}
+
+func (b pulseBlock) GetMove() Move {
+	return b.move
+}
+
 /*
-TODO: Processing the shapes here should generate and use some kind of table
-of cached values.
+STrapBlock creates a block with a jerk limited (s-curve) profile, see
+Profile. The ramp from frStart is limited by frAccel, and the ramp
+to frEnd by frDecel.
 */
-func STrapBlock(frJerk, frAccel, frStart float64,
+func STrapBlock(frJerk, frAccel, frDecel, frStart float64,
 	move Move, frEnd float64) (block MotionBlock, err error) {
 
-	pre := Trapezoid(
-		Pulse(frJerk, frAccel),
-		Pulse(-frJerk, -frAccel),
-		move.Fr()-frStart, 0,
-	)
-
-	post := Trapezoid(
-		Pulse(-frJerk, -frAccel),
-		Pulse(frJerk, frAccel),
-		frEnd-move.Fr(), 0,
-	)
-
-	shape := Trapezoid(
-		pre, post,
-		move.Delta().Dist(),
-		frStart)
+	shape := Profile(frJerk, frAccel, frDecel,
+		frStart, move.Fr(), frEnd,
+		move.Delta().Dist())
 
 	block = sTrapBlock{shape: shape, move: move}
 
@@ -101,42 +101,61 @@ func TrapBlock(frAccel, frStart float64, move Move, frEnd float64) (MotionBlock,
 	return trapBlock{shape: shape, move: move}, nil
 }
 
-// BlockIterator creates an position iterator channel for the desired sample
-// granularity, over the defined motion block.
-func BlockIterator(block MotionBlock, samplesPerSecond, eAdvanceK float64) <-chan vec.Vec4 {
-	clamp := func(x, max float64) float64 {
-		if x < 0 {
-			return 0
-		} else if x > max {
-			return max
-		}
-		return x
+/*
+PulseBlock changes velocity from frStart to frEnd with a single pulse of
+constant acceleration over the whole move, or moves at a constant velocity
+if they are the same. Used for moves too short for easing to matter.
+*/
+func PulseBlock(frStart float64, move Move, frEnd float64) (MotionBlock, error) {
+	dist := move.Delta().Dist()
+	if !(frStart+frEnd > 0) {
+		return nil, ErrEaseLimitPre
 	}
+	dv := frEnd - frStart
+	dt := 2 * dist / (frStart + frEnd)
+	shape := Trapezoid(Pulse(dv/dt, dv), Pulse(0, 0), dist, frStart)
+	return pulseBlock{shape: shape, move: move}, nil
+}
 
-	c := make(chan vec.Vec4, iteratorChanCap)
-	go func() {
-		shape := block.GetShape()
-		move := block.GetMove()
-		isPrint := move.IsPrintMove()
-
-		shape.Cache()
-
-		samples := int(shape.Dt() * samplesPerSecond)
-		div := shape.Dt() / float64(samples)
+// Iterator pulls the sampled positions of a motion block in order.
+type Iterator struct {
+	table      *Table
+	from, dir  vec.Vec4
+	dist, div  float64
+	i, samples int
+}
 
-		for i := 0; i < samples; i++ {
-			dt := float64(i) * div
-			d := clamp(shape.Int1At(dt, 0), move.Delta().Dist())
-			pos := move.From().Add(move.Delta().Norm().Mul(d))
+// BlockIterator creates a position iterator for the desired sample
+// granularity, over the defined motion block. Positions are sampled
+// from a Table of the block shape.
+func BlockIterator(block MotionBlock, samplesPerSecond float64) *Iterator {
+	shape := block.GetShape()
+	move := block.GetMove()
+
+	// uncached vectors keep the samples from allocating
+	it := &Iterator{
+		table: NewTable(shape),
+		from:  move.From().Cache(false),
+		dir:   move.Delta().Norm().Cache(false),
+		dist:  move.Delta().Dist(),
+	}
+	it.samples = int(shape.Dt() * samplesPerSecond)
+	it.div = shape.Dt() / float64(it.samples)
+	return it
+}
 
-			if isPrint {
-				eFac := shape.Apply(dt) * move.Delta().Norm().E() * eAdvanceK
-				pos = pos.Add(vec.NewVec4(0, 0, 0, eFac))
-			}
-			c <- pos
-		}
-		close(c)
-	}()
+// Next returns the next position, or false after the last sample.
+func (it *Iterator) Next() (pos vec.Vec4, ok bool) {
+	if it.i >= it.samples {
+		return
+	}
+	d := it.table.At(float64(it.i) * it.div)
+	it.i++
 
-	return c
+	if d < 0 {
+		d = 0
+	} else if d > it.dist {
+		d = it.dist
+	}
+	return it.from.Add(it.dir.Mul(d)), true
 }
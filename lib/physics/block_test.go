@@ -0,0 +1,123 @@
+package physics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+func testBlock(t testing.TB) MotionBlock {
+	move := NewMove(vec.NewVec4(0, 0, 0, 0), vec.NewVec4(30, 40, 0, 2), 150)
+	block, err := STrapBlock(1e5, 3000, 1000, 10, move, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestBlockIterator(t *testing.T) {
+	const sps = 10000
+	block := testBlock(t)
+	move := block.GetMove()
+
+	it := BlockIterator(block, sps)
+	last, n := move.From(), 0
+	for pos, ok := it.Next(); ok; pos, ok = it.Next() {
+		if d := pos.Sub(last).Dist(); d > move.Fr()/sps*1.01 {
+			t.Fatalf("sample %v moved too far: %v", n, d)
+		}
+		last = pos
+		n++
+	}
+	if n != int(block.GetShape().Dt()*sps) {
+		t.Fatalf("wrong number of samples: %v", n)
+	}
+	if d := move.To().Sub(last).Dist(); d > move.Fr()/sps {
+		t.Fatalf("last sample too far from the end: %v", d)
+	}
+	if _, ok := it.Next(); ok {
+		t.Fatal("iterator should be done")
+	}
+}
+
+func TestPulseBlock(t *testing.T) {
+	move := NewMove(vec.NewVec4(0, 0, 0, 0), vec.NewVec4(0.03, 0.04, 0, 0), 100)
+	for _, frs := range [][2]float64{{80, 100}, {100, 60}, {90, 90}, {0, 50}} {
+		block, err := PulseBlock(frs[0], move, frs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := block.GetShape()
+		if !s.IsValid() {
+			t.Fatalf("invalid shape for %v: %v", frs, s)
+		}
+		if a, b := s.Apply(0), Apply(s); math.Abs(a-frs[0]) > 1e-9 || math.Abs(b-frs[1]) > 1e-9 {
+			t.Fatalf("bad start/end velocity for %v: %v, %v", frs, a, b)
+		}
+		if d := s.Int1At(s.Dt(), 0); math.Abs(d-0.05) > 1e-9 {
+			t.Fatalf("bad distance for %v: %v", frs, d)
+		}
+		if typ := DescribeBlock(block).Type; typ != BlockPulse {
+			t.Fatalf("expected a %v block, got %v", BlockPulse, typ)
+		}
+	}
+	if _, err := PulseBlock(0, move, 0); err == nil {
+		t.Fatal("moves from rest to rest should not fit a single pulse")
+	}
+}
+
+func TestDescribeBlock(t *testing.T) {
+	const sps = 10000
+	block := testBlock(t)
+
+	info := DescribeBlock(block)
+	if info.Type != BlockSTrap || info.FrStart != 10 || math.Abs(info.FrEnd-20) > 1e-9 {
+		t.Fatalf("unexpected block info %+v", info)
+	}
+	if d := info.Accel + info.Cruise + info.Decel - info.Time; math.Abs(d) > 1e-12 {
+		t.Fatalf("durations are off by %v", d)
+	}
+
+	samples := SampleBlock(block, sps)
+	for i := 1; i < len(samples)-1; i++ {
+		pre, s, next := samples[i-1], samples[i], samples[i+1]
+		vel := next.Pos.Sub(pre.Pos).Div(next.Time - pre.Time)
+		if d := vel.Sub(s.Vel).Dist(); d > 1e-2 {
+			t.Fatalf("sample %v velocity %v does not match position (%v)", i, s.Vel, vel)
+		}
+	}
+}
+
+// chanIterator runs the iterator in a goroutine, sending each sample
+// over a channel. Used to benchmark against the pull based iterator.
+func chanIterator(block MotionBlock, samplesPerSecond float64) <-chan vec.Vec4 {
+	c := make(chan vec.Vec4, 64)
+	go func() {
+		it := BlockIterator(block, samplesPerSecond)
+		for pos, ok := it.Next(); ok; pos, ok = it.Next() {
+			c <- pos
+		}
+		close(c)
+	}()
+	return c
+}
+
+func BenchmarkBlockIterator(b *testing.B) {
+	block := testBlock(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		it := BlockIterator(block, 10000)
+		for _, ok := it.Next(); ok; _, ok = it.Next() {
+		}
+	}
+}
+
+func BenchmarkChanIterator(b *testing.B) {
+	block := testBlock(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for range chanIterator(block, 10000) {
+		}
+	}
+}
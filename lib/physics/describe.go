@@ -0,0 +1,87 @@
+package physics
+
+import "github.com/colinrgodsey/step-daemon/lib/vec"
+
+// Easing types of a MotionBlock.
+const (
+	BlockSTrap = "s-trap"
+	BlockTrap  = "trap"
+	BlockPulse = "pulse"
+)
+
+// BlockInfo describes the planned motion of a block. Times are in seconds.
+type BlockInfo struct {
+	Type     string   `json:"type"`
+	From     vec.Vec4 `json:"from"`
+	To       vec.Vec4 `json:"to"`
+	FrStart  float64  `json:"fr-start"`
+	FrCruise float64  `json:"fr-cruise"`
+	FrEnd    float64  `json:"fr-end"`
+
+	Accel  float64 `json:"accel-time"`
+	Cruise float64 `json:"cruise-time"`
+	Decel  float64 `json:"decel-time"`
+	Time   float64 `json:"time"`
+}
+
+// BlockSample is the motion along each axis at a single sample of a
+// block. Time is from the start of the block.
+type BlockSample struct {
+	Time float64  `json:"time"`
+	Pos  vec.Vec4 `json:"pos"`
+	Vel  vec.Vec4 `json:"vel"`
+	Acc  vec.Vec4 `json:"acc"`
+}
+
+// timedShape is a Shape split into its acceleration, cruise
+// and deceleration parts.
+type timedShape interface {
+	durations() (accel, cruise, decel float64)
+}
+
+// DescribeBlock returns the planned motion of the block.
+func DescribeBlock(block MotionBlock) BlockInfo {
+	shape := block.GetShape()
+	move := block.GetMove()
+
+	info := BlockInfo{
+		Type:     BlockTrap,
+		From:     move.From(),
+		To:       move.To(),
+		FrStart:  shape.Apply(0),
+		FrCruise: move.Fr(),
+		FrEnd:    Apply(shape),
+		Time:     shape.Dt(),
+	}
+	switch block.(type) {
+	case sTrapBlock:
+		info.Type = BlockSTrap
+	case pulseBlock:
+		info.Type = BlockPulse
+	}
+	if s, ok := shape.(timedShape); ok {
+		info.Accel, info.Cruise, info.Decel = s.durations()
+	}
+	return info
+}
+
+// SampleBlock returns the motion of the block at each sample
+// of its BlockIterator.
+func SampleBlock(block MotionBlock, samplesPerSecond float64) []BlockSample {
+	shape := block.GetShape()
+	move := block.GetMove()
+	dir := move.Delta().Norm()
+
+	it := BlockIterator(block, samplesPerSecond)
+	samples := make([]BlockSample, 0, it.samples)
+	for pos, ok := it.Next(); ok; pos, ok = it.Next() {
+		dt := float64(len(samples)) * it.div
+		samples = append(samples, BlockSample{
+			Time: dt,
+			Pos:  pos,
+			Vel:  dir.Mul(shape.Apply(dt)),
+			Acc:  dir.Mul(shape.Der1At(dt)),
+		})
+	}
+	return samples
+}
@@ -0,0 +1,185 @@
+package physics
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// Names of the supported kinematics.
+const (
+	KinematicsCartesian = "cartesian"
+	KinematicsCoreXY    = "corexy"
+	KinematicsCoreXZ    = "corexz"
+	KinematicsDelta     = "delta"
+)
+
+/*
+Kinematics converts cartesian positions to motor positions. Each motor
+has its own steps/mm and limits, in the same order as the cartesian axes
+for the settings reported by the device (M92, M201, M203). The E axis is
+always driven by its own motor.
+*/
+type Kinematics interface {
+	// Motors returns the motor positions for a cartesian position.
+	Motors(pos vec.Vec4) vec.Vec4
+
+	// MotorRates returns the highest rate of travel of each motor, per
+	// unit of cartesian travel, along the line from one position to another.
+	MotorRates(from, to vec.Vec4) vec.Vec4
+}
+
+// linearKinematics maps cartesian positions to motors with a matrix.
+type linearKinematics [4][4]float64
+
+func (k linearKinematics) Motors(pos vec.Vec4) vec.Vec4 {
+	var res [4]float64
+	for i, row := range k {
+		for j, x := range row {
+			res[i] += x * pos.GetAt(j)
+		}
+	}
+	return vec.NewVec4(res[:]...)
+}
+
+func (k linearKinematics) MotorRates(from, to vec.Vec4) vec.Vec4 {
+	return k.Motors(to.Sub(from).Norm()).Abs()
+}
+
+// Cartesian kinematics drive each axis with its own motor.
+var Cartesian Kinematics = kinematics[KinematicsCartesian]
+
+var kinematics = map[string]linearKinematics{
+	KinematicsCartesian: {
+		{1, 0, 0, 0},
+		{0, 1, 0, 0},
+		{0, 0, 1, 0},
+		{0, 0, 0, 1},
+	},
+	// A = X + Y, B = X - Y
+	KinematicsCoreXY: {
+		{1, 1, 0, 0},
+		{1, -1, 0, 0},
+		{0, 0, 1, 0},
+		{0, 0, 0, 1},
+	},
+	// A = X + Z, C = X - Z
+	KinematicsCoreXZ: {
+		{1, 0, 1, 0},
+		{0, 1, 0, 0},
+		{1, 0, -1, 0},
+		{0, 0, 0, 1},
+	},
+}
+
+// NewKinematics returns the named kinematics. The default is cartesian.
+// Deltas need their geometry, see NewDelta.
+func NewKinematics(name string) (Kinematics, error) {
+	if name == "" {
+		name = KinematicsCartesian
+	}
+	if k, ok := kinematics[name]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown kinematics %v", name)
+}
+
+// MotorLimit returns the highest cartesian rate along the line from one
+// position to another that keeps each motor within its own limit.
+func MotorLimit(k Kinematics, from, to, limits vec.Vec4) float64 {
+	rates := k.MotorRates(from, to)
+	limit := math.Inf(1)
+	for i := 0; i < 4; i++ {
+		if r := rates.GetAt(i); r > Eps {
+			limit = math.Min(limit, limits.GetAt(i)/r)
+		}
+	}
+	return limit
+}
+
+// InReach returns true if each motor can reach the position.
+func InReach(k Kinematics, pos vec.Vec4) bool {
+	m := k.Motors(pos)
+	for i := 0; i < 4; i++ {
+		if math.IsNaN(m.GetAt(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeltaTowerAngles are the angles (in degrees) of the A, B and C towers
+// of a delta, before trim. C is at the back of the bed.
+var DeltaTowerAngles = [3]float64{210, 330, 90}
+
+// DeltaGeometry describes a linear delta, as set in Marlin with M665 and M666.
+type DeltaGeometry struct {
+	Radius      float64    // horizontal distance from the center to each tower
+	DiagonalRod float64    // length of the arms from carriage to effector
+	AngleTrim   [3]float64 // degrees added to DeltaTowerAngles
+	EndstopAdj  [3]float64 // carriage offset of each tower endstop
+}
+
+/*
+delta drives the A, B and C carriages up and down the towers. Each
+carriage sits at the height of the effector, plus the height of its
+arm, found from the horizontal distance between the effector and the
+tower. Positions out of reach of an arm have NaN motor positions.
+*/
+type delta struct {
+	towers [3][2]float64
+	rod2   float64
+	adj    [3]float64
+}
+
+// NewDelta returns the kinematics of a linear delta.
+func NewDelta(g DeltaGeometry) (Kinematics, error) {
+	if !(g.Radius > 0) || !(g.DiagonalRod > g.Radius) {
+		return nil, fmt.Errorf("bad delta geometry, radius %v and diagonal rod %v", g.Radius, g.DiagonalRod)
+	}
+	k := &delta{rod2: g.DiagonalRod * g.DiagonalRod, adj: g.EndstopAdj}
+	for i, angle := range DeltaTowerAngles {
+		rad := (angle + g.AngleTrim[i]) * math.Pi / 180
+		k.towers[i] = [2]float64{g.Radius * math.Cos(rad), g.Radius * math.Sin(rad)}
+	}
+	return k, nil
+}
+
+// arm2 returns the height of the arm of tower i, squared.
+func (k *delta) arm2(i int, pos vec.Vec4) float64 {
+	dx, dy := pos.X()-k.towers[i][0], pos.Y()-k.towers[i][1]
+	return k.rod2 - dx*dx - dy*dy
+}
+
+func (k *delta) Motors(pos vec.Vec4) vec.Vec4 {
+	var res [3]float64
+	for i := range res {
+		res[i] = pos.Z() + math.Sqrt(k.arm2(i, pos)) + k.adj[i]
+	}
+	return vec.NewVec4(res[0], res[1], res[2], pos.E())
+}
+
+/*
+MotorRates finds the rate of each carriage at both ends of the line. Along
+a line, the rate of the arm height changes monotonically, so the highest
+rate is always at one of the ends. Rates grow without bound as an arm
+approaches horizontal, near the edges of the build volume.
+*/
+func (k *delta) MotorRates(from, to vec.Vec4) vec.Vec4 {
+	u := to.Sub(from).Norm()
+	var res [3]float64
+	for i := range res {
+		for _, pos := range [...]vec.Vec4{from, to} {
+			h2 := k.arm2(i, pos)
+			if !(h2 > 0) {
+				res[i] = math.Inf(1)
+				break
+			}
+			dx, dy := pos.X()-k.towers[i][0], pos.Y()-k.towers[i][1]
+			r := math.Abs(u.Z() - (dx*u.X()+dy*u.Y())/math.Sqrt(h2))
+			res[i] = math.Max(res[i], r)
+		}
+	}
+	return vec.NewVec4(res[0], res[1], res[2], math.Abs(u.E()))
+}
@@ -0,0 +1,119 @@
+package physics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+func TestKinematics(t *testing.T) {
+	pos := vec.NewVec4(10, 20, 5, 1)
+	tests := []struct {
+		name   string
+		motors vec.Vec4
+	}{
+		{KinematicsCartesian, vec.NewVec4(10, 20, 5, 1)},
+		{KinematicsCoreXY, vec.NewVec4(30, -10, 5, 1)},
+		{KinematicsCoreXZ, vec.NewVec4(15, 20, 5, 1)},
+	}
+	for _, test := range tests {
+		k, err := NewKinematics(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := k.Motors(pos); !m.Sub(test.motors).Abs().Within(vec.NewVec4(Eps, Eps, Eps, Eps)) {
+			t.Fatalf("%v: expected motors at %v, got %v", test.name, test.motors, m)
+		}
+	}
+	if _, err := NewKinematics("scara"); err == nil {
+		t.Fatal("expected an error for unknown kinematics")
+	}
+}
+
+func TestMotorLimit(t *testing.T) {
+	limits := vec.NewVec4(300, 300, 10, 50)
+	from := vec.NewVec4(0, 0, 0, 0)
+	tests := []struct {
+		name  string
+		to    vec.Vec4
+		limit float64
+	}{
+		{KinematicsCartesian, vec.NewVec4(10, 10, 0, 0), 300 * math.Sqrt2},
+		{KinematicsCoreXY, vec.NewVec4(10, 0, 0, 0), 300},
+		{KinematicsCoreXY, vec.NewVec4(10, 10, 0, 0), 300 / math.Sqrt2},
+		{KinematicsCoreXZ, vec.NewVec4(10, 0, 0, 0), 10}, // C uses the Z limit
+	}
+	for _, test := range tests {
+		k, _ := NewKinematics(test.name)
+		if l := MotorLimit(k, from, test.to, limits); math.Abs(l-test.limit) > 1e-9 {
+			t.Fatalf("%v to %v: expected limit %v, got %v", test.name, test.to, test.limit, l)
+		}
+	}
+}
+
+func testDelta(t *testing.T) Kinematics {
+	k, err := NewDelta(DeltaGeometry{Radius: 100, DiagonalRod: 200, EndstopAdj: [3]float64{0, -1, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestDelta(t *testing.T) {
+	k := testDelta(t)
+
+	// each arm is at the same height from the center
+	h := math.Sqrt(200*200 - 100*100)
+	if m := k.Motors(vec.NewVec4(0, 0, 5, 1)); !m.Sub(vec.NewVec4(5+h, 4+h, 5+h, 1)).Abs().Within(vec.NewVec4(Eps, Eps, Eps, Eps)) {
+		t.Fatalf("bad motors at center: %v", m)
+	}
+	// C tower is at the back
+	if m := k.Motors(vec.NewVec4(0, 100, 0, 0)); math.Abs(m.Z()-200) > Eps {
+		t.Fatalf("C arm should be vertical: %v", m)
+	}
+	if InReach(k, vec.NewVec4(0, -150, 0, 0)) {
+		t.Fatal("position should be out of reach of C")
+	}
+	if _, err := NewDelta(DeltaGeometry{Radius: 100, DiagonalRod: 50}); err == nil {
+		t.Fatal("expected an error for short rods")
+	}
+}
+
+func TestDeltaMotorRates(t *testing.T) {
+	k := testDelta(t)
+	lines := [][2]vec.Vec4{
+		{vec.NewVec4(-50, -50, 0, 0), vec.NewVec4(80, 20, 10, 1)},
+		{vec.NewVec4(0, 90, 0, 0), vec.NewVec4(0, -90, 0, 0)},
+		{vec.NewVec4(10, 10, 0, 0), vec.NewVec4(10, 10, 10, 0)},
+	}
+	for _, l := range lines {
+		from, to := l[0], l[1]
+		rates := k.MotorRates(from, to)
+
+		// the highest rate of each carriage, found from the motor positions
+		const n, h = 1000, 1e-3
+		dist := to.Sub(from).Dist()
+		dir := to.Sub(from).Norm()
+		var maxRates [4]float64
+		for i := 0; i <= n; i++ {
+			s := math.Min(dist*float64(i)/n, dist-h)
+			m0 := k.Motors(from.Add(dir.Mul(s)))
+			m1 := k.Motors(from.Add(dir.Mul(s + h)))
+			for j := range maxRates {
+				maxRates[j] = math.Max(maxRates[j], math.Abs(m1.GetAt(j)-m0.GetAt(j))/h)
+			}
+		}
+		for j, r := range maxRates {
+			if math.Abs(rates.GetAt(j)-r) > 1e-3*(1+r) {
+				t.Fatalf("%v to %v: expected rate %v for motor %v, got %v", from, to, r, j, rates.GetAt(j))
+			}
+		}
+	}
+
+	// arms approaching horizontal must slow down
+	slow := MotorLimit(k, vec.NewVec4(0, -90, 0, 0), vec.NewVec4(1, -95, 0, 0), vec.NewVec4(300, 300, 300, 50))
+	if slow > 100 {
+		t.Fatalf("expected the carriage limit near the edge, got %v", slow)
+	}
+}
@@ -62,6 +62,10 @@ func (m *Move) IsEOrZOnly() bool {
 	return m.delta.X() == 0 && m.delta.Y() == 0
 }
 
+func (m *Move) IsEOnly() bool {
+	return m.IsEOrZOnly() && m.delta.Z() == 0
+}
+
 func (m *Move) IsPrintMove() bool {
 	return m.delta.E() > 0 && !m.IsEOrZOnly()
 }
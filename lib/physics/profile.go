@@ -0,0 +1,304 @@
+package physics
+
+import (
+	"fmt"
+	"math"
+)
+
+// profileOrder is the highest integral cached at the start of each phase.
+const profileOrder = 3
+
+// phase is a span of constant jerk, starting at acceleration acc.
+type phase struct {
+	dt, acc, jerk float64
+}
+
+/*
+profile is a 7 phase jerk limited velocity profile: a ramp from the start
+velocity to the cruise velocity (increasing, constant, then decreasing
+acceleration), the cruise, and a ramp to the end velocity. Each ramp has
+its own acceleration limit, and ramps too short to reach the limit use a
+lower peak acceleration instead (see RampAccel).
+
+The acceleration, velocity and integrals at the start of each phase are
+cached, so any point is a short Taylor series from the phase start.
+*/
+type profile struct {
+	phases   [7]phase
+	starts   [7]float64                   // time at the start of each phase
+	state    [7][profileOrder + 2]float64 // acc, vel and integrals at each start
+	v0       float64
+	area, dt float64
+}
+
+func (s *profile) Area() float64 {
+	return s.area
+}
+
+func (s *profile) Dt() float64 {
+	return s.dt
+}
+
+func (s *profile) IsValid() bool {
+	for _, p := range s.phases {
+		if p.dt < -Eps {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *profile) Cache() {}
+
+func (s *profile) Der1At(dt float64) float64 {
+	i := s.phaseAt(dt)
+	return s.phases[i].acc + s.phases[i].jerk*(dt-s.starts[i])
+}
+
+func (s *profile) Apply(dt float64) float64 {
+	return s.intNAt(0, dt, nil)
+}
+
+func (s *profile) Int1At(dt, c0 float64) float64 {
+	i := s.phaseAt(dt)
+	return c0 + advance(s.state[i][:3], s.phases[i].jerk, dt-s.starts[i], 2)
+}
+
+func (s *profile) Int2At(dt, c0, c1 float64) float64 {
+	return s.intNAt(2, dt, []float64{c0, c1})
+}
+
+func (s *profile) Int3At(dt, c0, c1, c2 float64) float64 {
+	return s.intNAt(3, dt, []float64{c0, c1, c2})
+}
+
+// The integrals are linear in their constants, so the constants are
+// added to the integral from rest.
+func (s *profile) intNAt(n int, dt float64, cs []float64) float64 {
+	x, f := 0.0, 1.0 // f is dt^k/k!
+	for k := 0; k < n; k++ {
+		x += cs[k] * f
+		f *= dt / float64(k+1)
+	}
+
+	if n <= profileOrder {
+		i := s.phaseAt(dt)
+		return x + advance(s.state[i][:n+2], s.phases[i].jerk, dt-s.starts[i], n+1)
+	}
+
+	// higher integrals are walked through each phase
+	d := make([]float64, n+2)
+	d[1] = s.v0
+	for i, p := range s.phases {
+		if i == len(s.phases)-1 || dt <= s.starts[i]+p.dt {
+			d[0] = p.acc
+			return x + advance(d, p.jerk, dt-s.starts[i], n+1)
+		}
+		d[0] = p.acc
+		for k := len(d) - 1; k > 0; k-- {
+			d[k] = advance(d, p.jerk, p.dt, k)
+		}
+	}
+	return x
+}
+
+func (s *profile) durations() (accel, cruise, decel float64) {
+	for i, p := range s.phases {
+		switch {
+		case i < 3:
+			accel += p.dt
+		case i == 3:
+			cruise += p.dt
+		default:
+			decel += p.dt
+		}
+	}
+	return
+}
+
+// phaseAt returns the phase containing dt.
+func (s *profile) phaseAt(dt float64) int {
+	for i := len(s.starts) - 1; i > 0; i-- {
+		if dt > s.starts[i] {
+			return i
+		}
+	}
+	return 0
+}
+
+/*
+TimeAt returns the time at which the profile has covered dist, within
+the profile. Within a phase the distance is a cubic in time, which is
+solved in closed form.
+*/
+func (s *profile) TimeAt(dist float64) float64 {
+	i := len(s.phases) - 1
+	for i > 0 && s.state[i][2] > dist {
+		i--
+	}
+	p, st := s.phases[i], s.state[i]
+
+	// j/6 t^3 + a/2 t^2 + v t + x = 0
+	roots := solveCubic(p.jerk/6, p.acc/2, st[1], st[2]-dist)
+	best, bestErr := 0.0, math.Inf(1)
+	for _, t := range roots {
+		err := math.Max(-t, 0) + math.Max(t-p.dt, 0)
+		if err < bestErr {
+			best, bestErr = t, err
+		}
+	}
+	return s.starts[i] + math.Max(math.Min(best, p.dt), 0)
+}
+
+func (s *profile) String() string {
+	return fmt.Sprintf("Profile(v0: %v, area: %v, phases: %v)", s.v0, s.area, s.phases)
+}
+
+/*
+Profile creates a jerk limited velocity profile that starts at v0, cruises
+at v, ends at v1 and covers dist. The ramp to v is limited by accel, and
+the ramp to v1 by decel. A jerk of 0 gives constant acceleration ramps.
+The profile is invalid if the ramps alone cover more than dist.
+*/
+func Profile(jerk, accel, decel, v0, v, v1, dist float64) Shape {
+	s := &profile{v0: v0, area: dist}
+
+	pre := rampPhases(v-v0, accel, jerk)
+	post := rampPhases(v1-v, decel, jerk)
+
+	cruise := 0.0
+	if v != 0 {
+		cruise = (dist - RampDist(v0, v, accel, jerk) - RampDist(v, v1, decel, jerk)) / v
+	}
+	copy(s.phases[:3], pre[:])
+	s.phases[3] = phase{dt: cruise}
+	copy(s.phases[4:], post[:])
+
+	var d [profileOrder + 2]float64
+	d[1] = v0
+	for i, p := range s.phases {
+		s.starts[i] = s.dt
+		d[0] = p.acc
+		s.state[i] = d
+		for k := len(d) - 1; k > 0; k-- {
+			d[k] = advance(d[:], p.jerk, p.dt, k)
+		}
+		s.dt += p.dt
+	}
+	return s
+}
+
+// rampPhases returns the 3 phases that change velocity by dv.
+func rampPhases(dv, acc, jerk float64) (ps [3]phase) {
+	a := math.Copysign(RampAccel(dv, acc, jerk), dv)
+	if dv == 0 || a == 0 {
+		return
+	}
+	if jerk <= 0 {
+		ps[1] = phase{dt: dv / a, acc: a}
+		return
+	}
+	j := math.Copysign(jerk, dv)
+	tj := a / j
+	ps[0] = phase{dt: tj, jerk: j}
+	ps[1] = phase{dt: dv/a - tj, acc: a}
+	ps[2] = phase{dt: tj, acc: a, jerk: -j}
+	return
+}
+
+/*
+advance returns d[k] after dt, where d holds the acceleration, velocity
+and integrals at the start of a phase with constant jerk:
+
+	d[k](t+dt) = Σ d[k-i](t) dt^i/i! + jerk dt^(k+1)/(k+1)!
+*/
+func advance(d []float64, jerk, dt float64, k int) float64 {
+	x, f := 0.0, 1.0
+	for i := 0; i <= k; i++ {
+		x += d[k-i] * f
+		f *= dt / float64(i+1)
+	}
+	return x + jerk*f
+}
+
+// solveCubic returns the real roots of a t^3 + b t^2 + c t + d = 0.
+func solveCubic(a, b, c, d float64) []float64 {
+	if a == 0 {
+		return solveQuadratic(b, c, d)
+	}
+	b, c, d = b/a, c/a, d/a
+
+	// depressed cubic y^3 + py + q = 0, where t = y - b/3
+	p := c - b*b/3
+	q := 2*b*b*b/27 - b*c/3 + d
+	off := -b / 3
+
+	var roots []float64
+	disc := q*q/4 + p*p*p/27
+	if disc > 0 {
+		r := math.Sqrt(disc)
+		roots = []float64{math.Cbrt(-q/2+r) + math.Cbrt(-q/2-r) + off}
+	} else {
+		m := 2 * math.Sqrt(-p/3)
+		th := 0.0
+		if m != 0 {
+			th = math.Acos(math.Max(-1, math.Min(1, 3*q/(p*m)))) / 3
+		}
+		for k := 0.0; k < 3; k++ {
+			roots = append(roots, m*math.Cos(th-2*math.Pi*k/3)+off)
+		}
+	}
+
+	// polish the roots, as the cancellation above can lose precision
+	for i, t := range roots {
+		for n := 0; n < 2; n++ {
+			df := 3*t*t + 2*b*t + c
+			if df == 0 {
+				break
+			}
+			t -= (((t+b)*t+c)*t + d) / df
+		}
+		roots[i] = t
+	}
+	return roots
+}
+
+// solveQuadratic returns the real roots of a t^2 + b t + c = 0.
+func solveQuadratic(a, b, c float64) []float64 {
+	switch {
+	case a == 0 && b == 0:
+		return nil
+	case a == 0:
+		return []float64{-c / b}
+	}
+	disc := b*b - 4*a*c
+	if disc < 0 {
+		return []float64{-b / (2 * a)} // closest approach
+	}
+	q := -(b + math.Copysign(math.Sqrt(disc), b)) / 2
+	if q == 0 {
+		return []float64{0}
+	}
+	return []float64{q / a, c / q}
+}
+
+/*
+TimeAt returns the time at which s has covered dist, from the first
+integral of s. Profiles are solved in closed form, and other shapes
+are bisected.
+*/
+func TimeAt(s Shape, dist float64) float64 {
+	if p, ok := s.(*profile); ok {
+		return p.TimeAt(dist)
+	}
+	lo, hi := 0.0, s.Dt()
+	for i := 0; i < rampSolveIterations && hi-lo > Eps; i++ {
+		mid := (lo + hi) / 2
+		if s.Int1At(mid, 0) < dist {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
@@ -0,0 +1,142 @@
+package physics
+
+import (
+	"math"
+	"testing"
+)
+
+// checkIntegrals checks each integral of s against the derivative of the next.
+func checkIntegrals(t *testing.T, s Shape) {
+	const h = 1e-6
+	cs := []float64{0.3, -0.2, 0.1, 0.5}
+	for i := 0; i <= 100; i++ {
+		dt := s.Dt() * float64(i) / 100
+		ders := []float64{
+			(s.Apply(dt+h) - s.Apply(dt-h)) / (2 * h),
+			(s.Int1At(dt+h, cs[3]) - s.Int1At(dt-h, cs[3])) / (2 * h),
+			(s.Int2At(dt+h, cs[2], cs[3]) - s.Int2At(dt-h, cs[2], cs[3])) / (2 * h),
+			(s.Int3At(dt+h, cs[1], cs[2], cs[3]) - s.Int3At(dt-h, cs[1], cs[2], cs[3])) / (2 * h),
+			(intNAt(s, 4, dt+h, cs) - intNAt(s, 4, dt-h, cs)) / (2 * h),
+		}
+		vals := []float64{
+			s.Der1At(dt),
+			s.Apply(dt),
+			s.Int1At(dt, cs[3]),
+			s.Int2At(dt, cs[2], cs[3]),
+			s.Int3At(dt, cs[1], cs[2], cs[3]),
+		}
+		for n := range vals {
+			if n == 0 && (i == 0 || i == 100) {
+				continue // acceleration may jump at the ends
+			}
+			if d := math.Abs(ders[n] - vals[n]); d > 1e-3*(1+math.Abs(vals[n])) {
+				t.Fatalf("integral %v at %v: derivative %v, expected %v", n, dt, ders[n], vals[n])
+			}
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	const (
+		jerk, accel, decel = 1e5, 3000, 1000
+		v0, v, v1, dist    = 10, 150, 20, 60
+	)
+	s := Profile(jerk, accel, decel, v0, v, v1, dist)
+	if !s.IsValid() {
+		t.Fatalf("profile should be valid: %v", s)
+	}
+	if a, b := s.Apply(0), Apply(s); math.Abs(a-v0) > 1e-9 || math.Abs(b-v1) > 1e-9 {
+		t.Fatalf("bad start/end velocity: %v, %v", a, b)
+	}
+	if x := s.Int1At(s.Dt(), 0); math.Abs(x-dist) > 1e-9 {
+		t.Fatalf("bad distance: %v", x)
+	}
+
+	var maxAcc, maxDec float64
+	for i := 0; i <= 1000; i++ {
+		acc := s.Der1At(s.Dt() * float64(i) / 1000)
+		maxAcc = math.Max(maxAcc, acc)
+		maxDec = math.Max(maxDec, -acc)
+	}
+	if maxAcc > accel+1e-9 || maxDec > decel+1e-9 {
+		t.Fatalf("acceleration limits exceeded: %v, %v", maxAcc, maxDec)
+	}
+	if maxAcc < accel-1e-9 || maxDec < decel-1e-9 {
+		t.Fatalf("acceleration limits not reached: %v, %v", maxAcc, maxDec)
+	}
+
+	checkIntegrals(t, s)
+
+	// too short for the ramps
+	if s := Profile(jerk, accel, decel, v0, v, v1, 1); s.IsValid() {
+		t.Fatalf("profile should be invalid: %v", s)
+	}
+}
+
+func TestProfileShortRamp(t *testing.T) {
+	const accel, jerk = 3000, 1e5
+
+	// small velocity changes never reach the acceleration limit
+	s := Profile(jerk, accel, accel, 20, 25, 18, 5)
+	if !s.IsValid() {
+		t.Fatalf("profile should be valid: %v", s)
+	}
+	for i := 0; i <= 1000; i++ {
+		if acc := s.Der1At(s.Dt() * float64(i) / 1000); math.Abs(acc) > accel/2 {
+			t.Fatalf("peak acceleration should be reduced: %v", acc)
+		}
+	}
+	if b := Apply(s); math.Abs(b-18) > 1e-9 {
+		t.Fatalf("bad end velocity: %v", b)
+	}
+	checkIntegrals(t, s)
+}
+
+func TestTrapezoidInt3(t *testing.T) {
+	ramp := func(dv float64) Shape {
+		if dv < 0 {
+			return Trapezoid(Pulse(-1e5, -2000), Pulse(1e5, 2000), dv, 0)
+		}
+		return Trapezoid(Pulse(1e5, 2000), Pulse(-1e5, -2000), dv, 0)
+	}
+	s := Trapezoid(ramp(100), ramp(-100), 50, 0)
+	if !s.IsValid() {
+		t.Fatalf("trapezoid should be valid: %v", s)
+	}
+	checkIntegrals(t, s)
+}
+
+// plainShape hides the polyShape methods of a Shape.
+type plainShape struct {
+	Shape
+}
+
+func TestPlainShapeIntegrals(t *testing.T) {
+	s := Trapezoid(plainShape{Pulse(1e5, 2000)}, plainShape{Pulse(-1e5, -2000)}, 100, 0)
+	if !s.IsValid() {
+		t.Fatalf("trapezoid should be valid: %v", s)
+	}
+	checkIntegrals(t, s)
+	checkIntegrals(t, plainShape{s})
+}
+
+func TestTimeAt(t *testing.T) {
+	shapes := []Shape{
+		Profile(1e5, 3000, 1000, 10, 150, 20, 60),
+		Profile(1e5, 3000, 3000, 0, 25, 0, 5),
+		Profile(0, 3000, 1000, 0, 100, 0, 20),
+		Trapezoid(Pulse(3000, 100), Pulse(-3000, -100), 20, 0),
+	}
+	for _, s := range shapes {
+		for i := 0; i <= 100; i++ {
+			x := s.Area() * float64(i) / 100
+			dt := TimeAt(s, x)
+			if dt < 0 || dt > s.Dt()+1e-9 {
+				t.Fatalf("time out of range for %v: %v", x, dt)
+			}
+			if d := s.Int1At(dt, 0); math.Abs(d-x) > 1e-6 {
+				t.Fatalf("bad time for %v in %v: %v covers %v", x, s, dt, d)
+			}
+		}
+	}
+}
@@ -15,7 +15,7 @@ func (s pulse) Dt() float64 {
 }
 
 func (s pulse) IsValid() bool {
-	return s.dt >= 0
+	return s.dt > -Eps
 }
 
 func (s pulse) Cache() {}
@@ -41,6 +41,19 @@ func (s pulse) Int3At(dt, c0, c1, c2 float64) float64 {
 	return c0 + c1*dt + c2*dt2/2.0 + s.dy*dt*dt2/6.0
 }
 
+func (s pulse) intNAt(n int, dt float64, cs []float64) float64 {
+	x, f := 0.0, 1.0 // f is dt^k/k!
+	for k := 0; k < n; k++ {
+		x += cs[k] * f
+		f *= dt / float64(k+1)
+	}
+	return x + s.dy*f
+}
+
+func (s pulse) durations() (accel, cruise, decel float64) {
+	return 0, s.dt, 0
+}
+
 func (s pulse) String() string {
 	return fmt.Sprintf("Pulse(dy: %v, area: %v)", s.dy, s.area)
 }
@@ -0,0 +1,120 @@
+package physics
+
+import "math"
+
+const rampSolveIterations = 64
+
+// RampTime returns the time needed to change velocity by dv, with the
+// given max acceleration and s-jerk. A jerk of 0 gives a constant
+// acceleration ramp. Small changes in velocity never reach the max
+// acceleration with s-curve easing, and use a lower peak acceleration.
+func RampTime(dv, acc, jerk float64) float64 {
+	dv = math.Abs(dv)
+	switch {
+	case jerk <= 0:
+		return dv / acc
+	case dv*jerk >= acc*acc:
+		return dv/acc + acc/jerk
+	default:
+		return 2 * math.Sqrt(dv/jerk)
+	}
+}
+
+// RampAccel returns the peak acceleration used to change velocity by dv.
+func RampAccel(dv, acc, jerk float64) float64 {
+	if jerk <= 0 {
+		return acc
+	}
+	return math.Min(acc, math.Sqrt(math.Abs(dv)*jerk))
+}
+
+// RampDist returns the distance needed to change velocity from v0 to v1.
+// Both ramp shapes are symmetric, so the average velocity is the midpoint.
+func RampDist(v0, v1, acc, jerk float64) float64 {
+	return (v0 + v1) / 2 * RampTime(v1-v0, acc, jerk)
+}
+
+/*
+MaxRampVel returns the highest velocity reachable from v0 within dist.
+Each ramp shape has a closed form: ramps that reach the max acceleration
+are quadratic in the end velocity, and shorter s-curve ramps are a cubic
+in sqrt(dv/jerk).
+*/
+func MaxRampVel(v0, dist, acc, jerk float64) float64 {
+	fits := func(v float64) bool {
+		return RampDist(v0, v, acc, jerk) <= dist
+	}
+
+	if jerk <= 0 {
+		return fitDown(math.Sqrt(v0*v0+2*acc*dist), v0, fits)
+	}
+
+	// 2 acc dist = v^2 - v0^2 + k (v + v0)
+	k := acc * acc / jerk
+	if v := solveQuadratic(1, k, k*v0-v0*v0-2*acc*dist); len(v) > 0 {
+		if v := maxRoot(v); v-v0 >= k {
+			return fitDown(v, v0, fits)
+		}
+	}
+
+	// dist = (2 v0 + jerk u^2) u, where u = sqrt(dv/jerk)
+	u := math.Max(maxRoot(solveCubic(jerk, 0, 2*v0, -dist)), 0)
+	return fitDown(v0+jerk*u*u, v0, fits)
+}
+
+/*
+MaxCruiseVel returns the highest velocity, up to fr, that can be reached
+between a start and end velocity within dist. If both ramps reach the max
+acceleration the velocity is found in closed form, otherwise it is bisected
+to within Eps.
+*/
+func MaxCruiseVel(frStart, frEnd, fr, dist, acc, jerk float64) float64 {
+	fits := func(v float64) bool {
+		return RampDist(frStart, v, acc, jerk)+RampDist(v, frEnd, acc, jerk) <= dist
+	}
+
+	lo := math.Max(frStart, frEnd)
+	hi := fr
+	if lo >= hi || fits(hi) {
+		return hi
+	}
+
+	// 2 acc dist = 2v^2 + 2k v - v0^2 - v1^2 + k (v0 + v1)
+	k := 0.0
+	if jerk > 0 {
+		k = acc * acc / jerk
+	}
+	c := k*(frStart+frEnd) - frStart*frStart - frEnd*frEnd - 2*acc*dist
+	if v := solveQuadratic(2, 2*k, c); len(v) > 0 {
+		if v := maxRoot(v); v-lo >= k && v < hi {
+			return fitDown(v, lo, fits)
+		}
+	}
+
+	for i := 0; i < rampSolveIterations && hi-lo > Eps; i++ {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// fitDown steps a solved velocity down towards lo by a few ulps, if
+// rounding left it just past the fit.
+func fitDown(v, lo float64, fits func(float64) bool) float64 {
+	for i := 0; i < 16 && v > lo && !fits(v); i++ {
+		v = math.Nextafter(v, lo)
+	}
+	return v
+}
+
+func maxRoot(roots []float64) float64 {
+	x := math.Inf(-1)
+	for _, r := range roots {
+		x = math.Max(x, r)
+	}
+	return x
+}
@@ -0,0 +1,56 @@
+package physics
+
+import (
+	"math"
+	"testing"
+)
+
+var (
+	testV0s   = []float64{0, 1, 20, 150}
+	testDists = []float64{1e-4, 0.01, 0.5, 10, 300}
+	testAccs  = []float64{100, 3000}
+	testJerks = []float64{0, 1e3, 1e5, 1e8}
+)
+
+func TestMaxRampVel(t *testing.T) {
+	for _, v0 := range testV0s {
+		for _, dist := range testDists {
+			for _, acc := range testAccs {
+				for _, jerk := range testJerks {
+					v := MaxRampVel(v0, dist, acc, jerk)
+					if d := RampDist(v0, v, acc, jerk); d > dist || d < dist-1e-8 {
+						t.Fatalf("ramp from %v (acc: %v, jerk: %v) to %v covers %v, not %v",
+							v0, acc, jerk, v, d, dist)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestMaxCruiseVel(t *testing.T) {
+	const fr = 250
+	for _, v0 := range testV0s {
+		for _, dist := range testDists {
+			for _, acc := range testAccs {
+				for _, jerk := range testJerks {
+					v1 := math.Min(MaxRampVel(v0, dist, acc, jerk), 30)
+					v0 := math.Min(v0, MaxRampVel(v1, dist, acc, jerk))
+					ramps := func(v float64) float64 {
+						return RampDist(v0, v, acc, jerk) + RampDist(v, v1, acc, jerk)
+					}
+
+					v := MaxCruiseVel(v0, v1, fr, dist, acc, jerk)
+					switch {
+					case v < math.Max(v0, v1)-Eps || v > fr:
+						t.Fatalf("cruise %v out of range for %v, %v", v, v0, v1)
+					case ramps(v) > dist:
+						t.Fatalf("cruise %v does not fit %v (acc: %v, jerk: %v)", v, dist, acc, jerk)
+					case v < fr && ramps(v*(1+1e-6)) <= dist:
+						t.Fatalf("cruise %v is lower than needed for %v (acc: %v, jerk: %v)", v, dist, acc, jerk)
+					}
+				}
+			}
+		}
+	}
+}
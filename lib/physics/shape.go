@@ -15,6 +15,44 @@ type Shape interface {
 	Int3At(dt, c0, c1, c2 float64) float64
 }
 
+// polyShape is a Shape with integrals of any order. The constants
+// in cs are given outermost first, like the IntN methods.
+type polyShape interface {
+	intNAt(n int, dt float64, cs []float64) float64
+}
+
+// intSteps is the number of Simpson's rule intervals used to integrate
+// shapes that aren't a polyShape past Int3At.
+const intSteps = 64
+
+func intNAt(s Shape, n int, dt float64, cs []float64) float64 {
+	if p, ok := s.(polyShape); ok {
+		return p.intNAt(n, dt, cs)
+	}
+	switch n {
+	case 0:
+		return s.Apply(dt)
+	case 1:
+		return s.Int1At(dt, cs[0])
+	case 2:
+		return s.Int2At(dt, cs[0], cs[1])
+	case 3:
+		return s.Int3At(dt, cs[0], cs[1], cs[2])
+	}
+
+	// integrate the next integral down with Simpson's rule
+	h := dt / intSteps
+	sum := intNAt(s, n-1, 0, cs[1:]) + intNAt(s, n-1, dt, cs[1:])
+	for i := 1; i < intSteps; i++ {
+		w := 2.0
+		if i%2 == 1 {
+			w = 4
+		}
+		sum += w * intNAt(s, n-1, h*float64(i), cs[1:])
+	}
+	return cs[0] + sum*h/3
+}
+
 func Int1(s Shape, c0 float64) float64 {
 	//return s.Int1At(s.Dt(), c0)
 	return s.Area() + c0
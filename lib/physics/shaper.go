@@ -0,0 +1,205 @@
+package physics
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// vTol is the vibration tolerance used for the EI shapers.
+const vTol = 0.05
+
+type impulse struct {
+	a, t float64
+}
+
+// shaperDefs produce the impulses for each shaper type, as
+// described in the Klipper input shaper docs.
+var shaperDefs = map[string]func(freq, damping float64) []impulse{
+	"ZV": func(freq, damping float64) []impulse {
+		k, td := shaperKT(freq, damping)
+		return []impulse{{1, 0}, {k, 0.5 * td}}
+	},
+	"MZV": func(freq, damping float64) []impulse {
+		df := math.Sqrt(1 - damping*damping)
+		k := math.Exp(-0.75 * damping * math.Pi / df)
+		td := 1 / (freq * df)
+		a1 := 1 - 1/math.Sqrt2
+		a2 := (math.Sqrt2 - 1) * k
+		a3 := a1 * k * k
+		return []impulse{{a1, 0}, {a2, 0.375 * td}, {a3, 0.75 * td}}
+	},
+	"ZVD": func(freq, damping float64) []impulse {
+		k, td := shaperKT(freq, damping)
+		return []impulse{{1, 0}, {2 * k, 0.5 * td}, {k * k, td}}
+	},
+	"EI": func(freq, damping float64) []impulse {
+		k, td := shaperKT(freq, damping)
+		a1 := 0.25 * (1 + vTol)
+		a2 := 0.5 * (1 - vTol) * k
+		a3 := a1 * k * k
+		return []impulse{{a1, 0}, {a2, 0.5 * td}, {a3, td}}
+	},
+	"2HUMP_EI": func(freq, damping float64) []impulse {
+		k, td := shaperKT(freq, damping)
+		v2 := vTol * vTol
+		x := math.Pow(v2*(math.Sqrt(1-v2)+1), 1.0/3)
+		a1 := (3*x*x + 2*x + 3*v2) / (16 * x)
+		a2 := (0.5 - a1) * k
+		a3 := a2 * k
+		a4 := a1 * k * k * k
+		return []impulse{{a1, 0}, {a2, 0.5 * td}, {a3, td}, {a4, 1.5 * td}}
+	},
+}
+
+func shaperKT(freq, damping float64) (k, td float64) {
+	df := math.Sqrt(1 - damping*damping)
+	k = math.Exp(-damping * math.Pi / df)
+	td = 1 / (freq * df)
+	return
+}
+
+// InputShaper is a set of impulses that cancel out the ringing
+// of an axis at a specific resonance frequency.
+type InputShaper struct {
+	Type          string
+	Freq, Damping float64
+
+	impulses []impulse
+}
+
+// NewInputShaper creates a shaper of the named type (ZV, MZV, ZVD, EI or
+// 2HUMP_EI). A frequency of 0 creates a shaper that is disabled.
+func NewInputShaper(typ string, freq, damping float64) (InputShaper, error) {
+	s := InputShaper{Type: typ, Freq: freq, Damping: damping}
+	def, ok := shaperDefs[typ]
+	switch {
+	case typ == "" || freq == 0:
+		return s, nil
+	case !ok:
+		return s, fmt.Errorf("unknown input shaper type %v", typ)
+	case freq < 0 || damping < 0 || damping >= 1:
+		return s, fmt.Errorf("bad input shaper settings (freq: %v, damping: %v)", freq, damping)
+	}
+
+	s.impulses = def(freq, damping)
+	var sum float64
+	for _, imp := range s.impulses {
+		sum += imp.a
+	}
+	for i := range s.impulses {
+		s.impulses[i].a /= sum
+	}
+	return s, nil
+}
+
+// Enabled returns true if the shaper changes the signal.
+func (s InputShaper) Enabled() bool {
+	return len(s.impulses) > 0
+}
+
+// centroid is the average delay of the shaper.
+func (s InputShaper) centroid() (c float64) {
+	for _, imp := range s.impulses {
+		c += imp.a * imp.t
+	}
+	return
+}
+
+func (s InputShaper) String() string {
+	if !s.Enabled() {
+		return "disabled"
+	}
+	return fmt.Sprintf("%v (freq: %vHz, damping: %v)", s.Type, s.Freq, s.Damping)
+}
+
+// tap is an impulse delay in samples.
+type tap struct {
+	a, d float64
+}
+
+/*
+ShaperFilter convolves a position stream sampled at a fixed rate with
+the input shapers of the X and Y axes. The Z and E axes are delayed by
+the same average delay as the shaped axes, so all the axes stay in sync.
+*/
+type ShaperFilter struct {
+	taps [4][]tap
+
+	hist  []vec.Vec4 // ring of previous inputs
+	idx   int
+	still int // number of repeated inputs
+}
+
+// NewShaperFilter creates a filter starting from pos.
+func NewShaperFilter(x, y InputShaper, samplesPerSecond float64, pos vec.Vec4) *ShaperFilter {
+	shapers := [4]InputShaper{x, y}
+
+	var delay float64
+	for _, s := range shapers {
+		delay = math.Max(delay, s.centroid())
+	}
+
+	f := new(ShaperFilter)
+	maxD := 0.0
+	for i, s := range shapers {
+		imps := s.impulses
+		if !s.Enabled() {
+			imps = []impulse{{1, 0}}
+		}
+		offs := delay - s.centroid()
+		for _, imp := range imps {
+			d := (imp.t + offs) * samplesPerSecond
+			f.taps[i] = append(f.taps[i], tap{imp.a, d})
+			maxD = math.Max(maxD, d)
+		}
+	}
+	f.hist = make([]vec.Vec4, int(math.Ceil(maxD))+2)
+	f.Reset(pos)
+	return f
+}
+
+// Reset the filter history to a resting pos.
+func (f *ShaperFilter) Reset(pos vec.Vec4) {
+	for i := range f.hist {
+		f.hist[i] = pos
+	}
+	f.still = len(f.hist)
+}
+
+// Push the next sample, and get the shaped sample.
+func (f *ShaperFilter) Push(pos vec.Vec4) vec.Vec4 {
+	if pos.Eq(f.at(0)) {
+		f.still++
+	} else {
+		f.still = 0
+	}
+	f.idx = (f.idx + 1) % len(f.hist)
+	f.hist[f.idx] = pos
+
+	var out [4]float64
+	for i, taps := range f.taps {
+		for _, t := range taps {
+			k := math.Floor(t.d)
+			w := t.d - k
+			a, b := f.at(int(k)).GetAt(i), f.at(int(k)+1).GetAt(i)
+			out[i] += t.a * (a + (b-a)*w)
+		}
+	}
+	return vec.NewVec4(out[:]...)
+}
+
+// at returns the input from n samples ago.
+func (f *ShaperFilter) at(n int) vec.Vec4 {
+	return f.hist[(f.idx-n+len(f.hist))%len(f.hist)]
+}
+
+// Drain holds the last position until the output comes to rest
+// there, passing each shaped sample to emit.
+func (f *ShaperFilter) Drain(emit func(vec.Vec4)) {
+	last := f.at(0)
+	for f.still < len(f.hist) {
+		emit(f.Push(last))
+	}
+}
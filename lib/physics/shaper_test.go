@@ -0,0 +1,67 @@
+package physics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// residual vibration of a shaper at freq, relative to an unshaped step.
+func residual(s InputShaper, freq float64) float64 {
+	w := 2 * math.Pi * freq
+	wd := w * math.Sqrt(1-s.Damping*s.Damping)
+	tn := s.impulses[len(s.impulses)-1].t
+
+	var c, sn float64
+	for _, imp := range s.impulses {
+		e := imp.a * math.Exp(-s.Damping*w*(tn-imp.t))
+		c += e * math.Cos(wd*imp.t)
+		sn += e * math.Sin(wd*imp.t)
+	}
+	return math.Sqrt(c*c + sn*sn)
+}
+
+func TestInputShapers(t *testing.T) {
+	for typ := range shaperDefs {
+		s, err := NewInputShaper(typ, 50, 0.1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := residual(s, 50); v > vTol+1e-6 {
+			t.Fatalf("%v leaves %v of the vibration", s, v)
+		}
+
+		var sum float64
+		for _, imp := range s.impulses {
+			sum += imp.a
+		}
+		if math.Abs(sum-1) > 1e-12 {
+			t.Fatalf("%v is not normalized (%v)", s, sum)
+		}
+	}
+
+	if _, err := NewInputShaper("FOO", 50, 0.1); err == nil {
+		t.Fatal("Expected error for unknown type")
+	}
+}
+
+func TestShaperFilter(t *testing.T) {
+	x, _ := NewInputShaper("EI", 40, 0.1)
+	y, _ := NewInputShaper("ZV", 60, 0)
+	f := NewShaperFilter(x, y, 20480, vec.Vec4{})
+
+	// step input ends at rest on the target
+	target := vec.NewVec4(1, 2, 3, 4)
+	first := f.Push(target)
+	if first.X() >= 1 || first.Y() >= 2 {
+		t.Fatalf("Step was not shaped: %v", first)
+	}
+	var last vec.Vec4
+	f.Drain(func(pos vec.Vec4) {
+		last = pos
+	})
+	if last.Sub(target).Dist() > 1e-9 {
+		t.Fatalf("Shaped output did not settle: %v", last)
+	}
+}
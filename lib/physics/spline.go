@@ -0,0 +1,113 @@
+package physics
+
+import (
+	"math"
+
+	"github.com/colinrgodsey/cartesius/f64"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// splineSamples is the number of samples used to find the length
+// and curvature of a spline.
+const splineSamples = 256
+
+// SplinePoint is the end point of a chord along a spline, with the highest
+// curvature of the spline along the chord.
+type SplinePoint struct {
+	Pos       vec.Vec4
+	Curvature float64
+}
+
+// bezier is a cubic Bezier curve in XY.
+type bezier [4]f64.Vec2
+
+func (b bezier) at(t float64) f64.Vec2 {
+	u := 1 - t
+	return b[0].Mul(u * u * u).Add(b[1].Mul(3 * u * u * t)).
+		Add(b[2].Mul(3 * u * t * t)).Add(b[3].Mul(t * t * t))
+}
+
+// curvature returns the curvature at t, or +Inf at a cusp.
+func (b bezier) curvature(t float64) float64 {
+	u := 1 - t
+	d0, d1, d2 := b[1].Sub(b[0]), b[2].Sub(b[1]), b[3].Sub(b[2])
+	v := d0.Mul(3 * u * u).Add(d1.Mul(6 * u * t)).Add(d2.Mul(3 * t * t))
+	a := d1.Sub(d0).Mul(6 * u).Add(d2.Sub(d1).Mul(6 * t))
+	speed := v.Mag()
+	if speed == 0 {
+		return math.Inf(1)
+	}
+	return math.Abs(v[0]*a[1]-v[1]*a[0]) / (speed * speed * speed)
+}
+
+/*
+Spline splits a cubic Bezier spline (as used by G5) into chords, and returns
+the end point of each chord. The spline runs in XY from one position to
+another, with the control points c1 and c2. Z and E travel linearly with the
+distance along the spline.
+
+The chords are of equal length along the spline, so a move through them keeps
+its fr, and deviate at most tolerance from the spline. The curvature of each
+chord is capped at 1/tolerance, as tighter turns can not be resolved.
+*/
+func Spline(from, to vec.Vec4, c1, c2 f64.Vec2, tolerance float64) []SplinePoint {
+	b := bezier{from.XY(), c1, c2, to.XY()}
+
+	// length and curvature at each sample
+	var lengths, curves [splineSamples + 1]float64
+	maxCurve := 0.0
+	pre := b[0]
+	for i := range lengths {
+		t := float64(i) / splineSamples
+		p := b.at(t)
+		if i > 0 {
+			lengths[i] = lengths[i-1] + p.Sub(pre).Mag()
+		}
+		curves[i] = math.Min(b.curvature(t), 1/tolerance)
+		maxCurve = math.Max(maxCurve, curves[i])
+		pre = p
+	}
+	length := lengths[splineSamples]
+	if length == 0 {
+		return []SplinePoint{{to, 0}}
+	}
+
+	// a chord of length s deviates about curvature * s^2 / 8
+	n := 1
+	if maxCurve > 0 {
+		n = int(math.Ceil(length / math.Sqrt(8*tolerance/maxCurve)))
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	points := make([]SplinePoint, n)
+	j := 0
+	for i := 1; i <= n; i++ {
+		f := float64(i) / float64(n)
+		s := length * f
+
+		curve := curves[j]
+		for j < splineSamples && lengths[j+1] < s {
+			j++
+			curve = math.Max(curve, curves[j])
+		}
+		if j < splineSamples {
+			curve = math.Max(curve, curves[j+1])
+		}
+		if i == n {
+			points[i-1] = SplinePoint{to, curve}
+			break
+		}
+
+		// t of the point, between the samples around it
+		t := float64(j) / splineSamples
+		if dl := lengths[j+1] - lengths[j]; dl > 0 {
+			t += (s - lengths[j]) / dl / splineSamples
+		}
+		p := b.at(t)
+		pos := vec.NewVec4(p[0], p[1], from.Z()+(to.Z()-from.Z())*f, from.E()+(to.E()-from.E())*f)
+		points[i-1] = SplinePoint{pos, curve}
+	}
+	return points
+}
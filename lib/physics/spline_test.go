@@ -0,0 +1,70 @@
+package physics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/colinrgodsey/cartesius/f64"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+func TestSpline(t *testing.T) {
+	const tol = 0.01
+	from, to := vec.NewVec4(0, 0, 0, 0), vec.NewVec4(30, 0, 3, 2)
+	c1, c2 := f64.Vec2{10, 20}, f64.Vec2{20, -20}
+	b := bezier{f64.Vec2(from.XY()), c1, c2, f64.Vec2(to.XY())}
+
+	points := Spline(from, to, c1, c2, tol)
+	if len(points) < 2 {
+		t.Fatalf("Expected the spline to be split, got %v", points)
+	}
+	if !points[len(points)-1].Pos.Eq(to) {
+		t.Fatalf("Spline should end at %v, got %v", to, points[len(points)-1].Pos)
+	}
+
+	// chords have equal length along the spline, with Z and E moving linearly
+	var lengths []float64
+	pre, length := b.at(0), 0.0
+	j := 0
+	for i := 1; i <= 10000 && j < len(points); i++ {
+		p := b.at(float64(i) / 10000)
+		length += p.Sub(pre).Mag()
+		pre = p
+		if end := f64.Vec2(points[j].Pos.XY()); p.Sub(end).Mag() < 0.01 {
+			lengths = append(lengths, length)
+			j++
+		}
+	}
+	if len(lengths) != len(points) {
+		t.Fatalf("Chord ends are off the spline")
+	}
+	for i, l := range lengths {
+		f := float64(i+1) / float64(len(points))
+		if math.Abs(l-length*f) > 0.02 {
+			t.Fatalf("Chord %v ends at length %v, expected %v", i, l, length*f)
+		}
+		pos := points[i].Pos
+		if math.Abs(pos.Z()-3*f) > 1e-9 || math.Abs(pos.E()-2*f) > 1e-9 {
+			t.Fatalf("Z and E should move with the length, got %v", pos)
+		}
+	}
+
+	// chords stay within the tolerance of the spline
+	pre = b.at(0)
+	for _, p := range points {
+		mid := pre.Add(f64.Vec2(p.Pos.XY())).Mul(0.5)
+		dist := math.Inf(1)
+		for i := 0; i <= 10000; i++ {
+			dist = math.Min(dist, b.at(float64(i)/10000).Sub(mid).Mag())
+		}
+		if dist > tol*1.1 {
+			t.Fatalf("Chord to %v deviates %v", p.Pos, dist)
+		}
+		pre = f64.Vec2(p.Pos.XY())
+	}
+
+	// straight splines are a single chord
+	if points := Spline(from, to, f64.Vec2{10, 0}, f64.Vec2{20, 0}, tol); len(points) != 1 || points[0].Curvature != 0 {
+		t.Fatalf("Expected a single straight chord, got %v", points)
+	}
+}
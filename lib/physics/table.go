@@ -0,0 +1,113 @@
+package physics
+
+// piece is a span of a Shape as a polynomial in the time from its
+// start, with coefficients c in increasing order.
+type piece struct {
+	t0, dt float64
+	c      []float64
+}
+
+func (p piece) at(dt float64) (x float64) {
+	for i := len(p.c) - 1; i >= 0; i-- {
+		x = x*dt + p.c[i]
+	}
+	return
+}
+
+// int1 returns the integral of the piece, starting at c0.
+func (p piece) int1(c0 float64) piece {
+	c := make([]float64, len(p.c)+1)
+	c[0] = c0
+	for i, x := range p.c {
+		c[i+1] = x / float64(i+1)
+	}
+	return piece{p.t0, p.dt, c}
+}
+
+// piecewise is a Shape that can be split into polynomial pieces. Shapes
+// built from other shapes are only piecewise if each part is.
+type piecewise interface {
+	pieces() ([]piece, bool)
+}
+
+func shapePieces(s Shape) ([]piece, bool) {
+	if p, ok := s.(piecewise); ok {
+		return p.pieces()
+	}
+	return nil, false
+}
+
+// int1Pieces returns the pieces of the first integral of ps, starting at
+// c0. Each piece starts at the end value of the piece before it.
+func int1Pieces(ps []piece, t0, c0 float64) []piece {
+	res := make([]piece, len(ps))
+	for i, p := range ps {
+		p.t0 += t0
+		res[i] = p.int1(c0)
+		c0 = res[i].at(p.dt)
+	}
+	return res
+}
+
+func (s pulse) pieces() ([]piece, bool) {
+	return []piece{{0, s.dt, []float64{s.dy}}}, true
+}
+
+func (s *trapezoid) pieces() ([]piece, bool) {
+	head, ok := shapePieces(s.head)
+	if !ok {
+		return nil, false
+	}
+	tail, ok := shapePieces(s.tail)
+	if !ok {
+		return nil, false
+	}
+	ps := int1Pieces(head, 0, s.c)
+	ps = append(ps, piece{s.head.Dt(), s.middle.dt, []float64{s.middle.dy}})
+	return append(ps, int1Pieces(tail, s.dtTail, s.middle.dy)...), true
+}
+
+func (s *profile) pieces() ([]piece, bool) {
+	ps := make([]piece, len(s.phases))
+	for i, p := range s.phases {
+		st := s.state[i]
+		ps[i] = piece{s.starts[i], p.dt, []float64{st[1], p.acc, p.jerk / 2}}
+	}
+	return ps, true
+}
+
+/*
+Table is the position along a Shape (its first integral), cached as
+polynomial pieces. Sampling the table at increasing times walks the
+pieces in order, so each sample is a single polynomial evaluation.
+Shapes that can't be split into pieces are sampled with Int1At instead.
+*/
+type Table struct {
+	ps []piece
+	i  int
+	s  Shape // set if s isn't piecewise
+}
+
+// NewTable builds the position table for s.
+func NewTable(s Shape) *Table {
+	ps, ok := shapePieces(s)
+	if !ok {
+		return &Table{s: s}
+	}
+	return &Table{ps: int1Pieces(ps, 0, 0)}
+}
+
+// At returns the position at dt. Sampling is fastest with increasing dt.
+func (t *Table) At(dt float64) float64 {
+	if t.s != nil {
+		return t.s.Int1At(dt, 0)
+	}
+	if t.i > 0 && dt < t.ps[t.i].t0 {
+		t.i = 0
+	}
+	for t.i < len(t.ps)-1 && dt > t.ps[t.i+1].t0 {
+		t.i++
+	}
+	p := t.ps[t.i]
+	return p.at(dt - p.t0)
+}
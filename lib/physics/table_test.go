@@ -0,0 +1,63 @@
+package physics
+
+import (
+	"math"
+	"testing"
+)
+
+func testShapes() []Shape {
+	ramp := func(dv float64) Shape {
+		if dv < 0 {
+			return Trapezoid(Pulse(-1e5, -2000), Pulse(1e5, 2000), dv, 0)
+		}
+		return Trapezoid(Pulse(1e5, 2000), Pulse(-1e5, -2000), dv, 0)
+	}
+	return []Shape{
+		Pulse(100, 20),
+		Trapezoid(Pulse(3000, 100), Pulse(-3000, -80), 20, 10),
+		Trapezoid(ramp(100), ramp(-100), 50, 0),
+		Profile(1e5, 3000, 1000, 10, 150, 20, 60),
+		Profile(0, 3000, 1000, 0, 100, 0, 20),
+		plainShape{Pulse(100, 20)},
+		Trapezoid(plainShape{Pulse(3000, 100)}, Pulse(-3000, -80), 20, 10),
+	}
+}
+
+func TestTable(t *testing.T) {
+	for _, s := range testShapes() {
+		table := NewTable(s)
+		for i := 0; i <= 1000; i++ {
+			dt := s.Dt() * float64(i) / 1000
+			if d := math.Abs(table.At(dt) - s.Int1At(dt, 0)); d > Eps {
+				t.Fatalf("table for %v differs by %v at %v", s, d, dt)
+			}
+		}
+		// out of order
+		if d := math.Abs(table.At(0) - s.Int1At(0, 0)); d > Eps {
+			t.Fatalf("table for %v differs by %v at 0", s, d)
+		}
+	}
+}
+
+func benchmarkSampling(b *testing.B, sample func(s Shape) func(dt float64) float64) {
+	shapes := testShapes()
+	for i := 0; i < b.N; i++ {
+		s := shapes[i%len(shapes)]
+		f := sample(s)
+		for j := 0; j < 1000; j++ {
+			f(s.Dt() * float64(j) / 1000)
+		}
+	}
+}
+
+func BenchmarkInt1At(b *testing.B) {
+	benchmarkSampling(b, func(s Shape) func(dt float64) float64 {
+		return func(dt float64) float64 { return s.Int1At(dt, 0) }
+	})
+}
+
+func BenchmarkTable(b *testing.B) {
+	benchmarkSampling(b, func(s Shape) func(dt float64) float64 {
+		return NewTable(s).At
+	})
+}
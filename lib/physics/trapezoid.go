@@ -40,42 +40,55 @@ func (s *trapezoid) Der1At(dt float64) float64 {
 }
 
 func (s *trapezoid) Apply(dt float64) float64 {
-	switch {
-	case dt == s.dtTail && s.cacheReady:
+	if dt == s.dtTail && s.cacheReady {
 		return s.applyCache
-	case dt > s.dtTail:
-		return s.tail.Int1At(dt-s.dtTail, s.Apply(s.dtTail))
-	case dt > s.head.Dt():
-		return s.Apply(s.head.Dt())
-	default:
-		return s.head.Int1At(dt, s.c) //TODO: should s.c be s.Apply(0) ? probably doesnt matter
 	}
+	return s.intNAt(0, dt, nil)
 }
 
 func (s *trapezoid) Int1At(dt, c0 float64) float64 {
-	switch {
-	case dt > s.dtTail:
-		return s.tail.Int2At(dt-s.dtTail, s.Int1At(s.dtTail, c0), s.Apply(s.dtTail))
-	case dt > s.head.Dt():
-		return s.middle.Int1At(dt-s.head.Dt(), s.Int1At(s.head.Dt(), c0))
-	default:
-		return s.head.Int2At(dt, c0, s.c)
-	}
+	return s.intNAt(1, dt, []float64{c0})
 }
 
 func (s *trapezoid) Int2At(dt, c0, c1 float64) float64 {
+	return s.intNAt(2, dt, []float64{c0, c1})
+}
+
+func (s *trapezoid) Int3At(dt, c0, c1, c2 float64) float64 {
+	return s.intNAt(3, dt, []float64{c0, c1, c2})
+}
+
+/*
+The nth integral of a trapezoid is the (n+1)th integral of the head
+or tail, or the nth integral of the middle pulse. Each part starts
+with the integrals of the parts before it as its constants.
+*/
+func (s *trapezoid) intNAt(n int, dt float64, cs []float64) float64 {
 	switch {
 	case dt > s.dtTail:
-		return s.tail.Int3At(dt-s.dtTail, s.Int2At(s.dtTail, c0, c1), s.Int1At(s.dtTail, c1), s.Apply(s.dtTail))
+		return intNAt(s.tail, n+1, dt-s.dtTail, s.startAt(s.dtTail, cs))
 	case dt > s.head.Dt():
-		return s.middle.Int2At(dt-s.head.Dt(), s.Int2At(s.head.Dt(), c0, c1), s.Int1At(s.head.Dt(), c1))
+		return intNAt(s.middle, n, dt-s.head.Dt(), s.startAt(s.head.Dt(), cs)[:n])
 	default:
-		return s.head.Int3At(dt, c0, c1, s.c)
+		//TODO: should s.c be s.Apply(0) ? probably doesnt matter
+		return intNAt(s.head, n+1, dt, append(cs[:n:n], s.c))
 	}
 }
 
-func (s *trapezoid) Int3At(dt, c0, c1, c2 float64) float64 {
-	panic("Trapezoid does not implement the 3rd integral")
+// startAt returns the constants for a part starting at dt: each
+// integral at dt, outermost first, followed by the value at dt.
+func (s *trapezoid) startAt(dt float64, cs []float64) []float64 {
+	n := len(cs)
+	res := make([]float64, n+1)
+	for k := 0; k < n; k++ {
+		res[k] = s.intNAt(n-k, dt, cs[k:])
+	}
+	res[n] = s.Apply(dt)
+	return res
+}
+
+func (s *trapezoid) durations() (accel, cruise, decel float64) {
+	return s.head.Dt(), s.middle.dt, s.tail.Dt()
 }
 
 func (s *trapezoid) String() string {
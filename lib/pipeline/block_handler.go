@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/colinrgodsey/step-daemon/lib/gcode"
+	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/physics"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+type blockHandler struct {
+	head, tail io.Conn
+	settings   []string
+
+	f   func(PlannedBlock)
+	pos vec.Vec4
+}
+
+func (h *blockHandler) headRead(msg io.Any) {
+	switch msg := msg.(type) {
+	case gcode.GCode:
+		switch {
+		case msg.IsM(503): // report settings
+			for _, line := range h.settings {
+				h.head.Write(line)
+			}
+			h.head.Write("ok")
+		case msg.IsM(114): // get pos
+			h.head.Write(fmt.Sprintf("X:%.2f Y:%.2f Z:%.2f E:%.2f Count X:0 Y:0 Z:0",
+				h.pos.X(), h.pos.Y(), h.pos.Z(), h.pos.E()))
+		case msg.IsM(400): // wait for moves
+			h.head.Write(Synced{}) // blocks are done when planned
+		case msg.IsG(28): // home
+			h.pos = vec.NewVec4(0, 0, 0, h.pos.E())
+		case msg.IsG(92): // set pos
+			h.pos = msg.Args.GetVec4(h.pos)
+		}
+	case PlannedBlock:
+		h.procBlock(msg)
+	case physics.MotionBlock:
+		h.procBlock(PlannedBlock{MotionBlock: msg})
+	}
+}
+
+func (h *blockHandler) procBlock(block PlannedBlock) {
+	move := block.GetMove()
+	h.pos = move.To()
+	h.f(block)
+}
+
+/*
+BlockHandler takes the place of the device, so the planned motion blocks
+can be used without one. Each block is passed to f in order. The device
+settings are the M503 response lines to report.
+*/
+func BlockHandler(settings []string, f func(PlannedBlock)) Handler {
+	return func(sup *Supervisor, head, tail io.Conn) {
+		h := blockHandler{
+			head: head, tail: tail,
+			settings: settings,
+			f:        f,
+		}
+
+		// there is no device to put in a safe state
+		sup.Go(func() {
+			select {
+			case <-sup.Fault():
+				sup.markSafe()
+			case <-sup.Context().Done():
+			}
+		})
+
+		head.Write("pages_ready")
+		for msg, ok := head.Read(); ok; msg, ok = head.Read() {
+			h.headRead(msg)
+		}
+		tail.Close()
+		head.Close()
+	}
+}
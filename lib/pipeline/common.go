@@ -1,5 +1,10 @@
 package pipeline
 
+import (
+	"github.com/colinrgodsey/step-daemon/lib/config"
+	"github.com/colinrgodsey/step-daemon/lib/physics"
+)
+
 type PageData struct {
 	Steps, Speed int
 	HasDirs      bool
@@ -7,6 +12,30 @@ type PageData struct {
 	Data         []byte
 }
 
+// PlannedBlock is a motion block sent by the PhysicsHandler, with
+// details of how the planner had to change the move.
+type PlannedBlock struct {
+	physics.MotionBlock
+
+	Resized        bool // slowed down to the velocity or step rate limits
+	SCurveFallback bool // eased with a trapezoid, as the s-curve failed
+}
+
+// PathMove is a move that is continued by the next move, such as a chord
+// of an arc. The PhysicsHandler plans them together, without stopping
+// between them, even if they are not print moves.
+type PathMove struct {
+	physics.Move
+}
+
+// Synced is sent upstream by DeviceHandler once all the pages before an
+// M400 have run. SourceHandler holds the ok of the M400 until then.
+type Synced struct{}
+
+// DeviceRestart is sent upstream by SourceHandler when the device restarts
+// unexpectedly. The pipeline must be rebuilt after this.
+type DeviceRestart struct{}
+
 func clamp(f float64) float64 {
 	if f < 0 {
 		return 0
@@ -15,3 +44,16 @@ func clamp(f float64) float64 {
 	}
 	return f
 }
+
+// newKinematics returns the kinematics of the config.
+func newKinematics(conf config.Config) (physics.Kinematics, error) {
+	if conf.Kinematics != physics.KinematicsDelta {
+		return physics.NewKinematics(conf.Kinematics)
+	}
+	return physics.NewDelta(physics.DeltaGeometry{
+		Radius:      conf.Delta.Radius,
+		DiagonalRod: conf.Delta.DiagonalRod,
+		AngleTrim:   conf.Delta.TowerAngleTrim,
+		EndstopAdj:  conf.Delta.EndstopOffsets,
+	})
+}
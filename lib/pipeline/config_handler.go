@@ -3,7 +3,6 @@ package pipeline
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -17,9 +16,6 @@ const (
 	blEnd   = "Bilinear Leveling Grid:"
 	blStart = "G29 Auto Bed Leveling"
 
-	//TODO: this is brittle... need to account for the exact configs we're expecting
-	confEnd = "echo:; Advanced:"
-
 	checkActiveMagic = "__check_active__"
 
 	devSettingsTimeout = 15 * time.Second
@@ -28,12 +24,14 @@ const (
 
 type cfHandler struct {
 	head, tail io.Conn
+	sup        *Supervisor
 
 	conf config.Config
 
 	samples []bed.Sample
 	zFunc   bed.ZFunc
 
+	gathering bool // waiting for the ok of M503
 	isReady   bool
 	active    bool
 	confReady chan struct{}
@@ -66,12 +64,15 @@ func (h *cfHandler) tailRead(msg io.Any) {
 		} else if strings.Index(msg, blStart) == 0 {
 			h.head.Write("info:collection bed-level samples")
 			h.samples = nil
-		} else if strings.Index(msg, confEnd) == 0 {
+		} else if msg == "ok" && h.gathering {
+			// the settings were all forwarded before the ok, and it is not for upstream
+			h.gathering = false
 			if !h.isReady {
 				h.head.Write("info:finished gathering device settings")
 				close(h.confReady)
 				h.isReady = true
 			}
+			return
 		} else if msg == "pages_ready" && !h.active {
 			h.active = true
 			h.gatherSettings()
@@ -88,7 +89,7 @@ func (h *cfHandler) tailRead(msg io.Any) {
 				h.tail.Write(string(bytes))
 				h.head.Write("sending test config")
 			} else {
-				panic(err)
+				h.sup.Fail(newError("config", KindConfig, "failed to encode config: %v", err))
 			}
 		} else {
 			h.checkConfig(msg)
@@ -99,6 +100,7 @@ func (h *cfHandler) tailRead(msg io.Any) {
 
 func (h *cfHandler) gatherSettings() {
 	h.head.Write("info:gathering device settings")
+	h.gathering = true
 	h.tail.Write(gcode.New('M', 503)) // report settings
 }
 
@@ -112,7 +114,7 @@ func (h *cfHandler) checkConfig(line string) {
 		return
 	}
 	switch g.CommandCode {
-	case 92, 203, 201, 204:
+	case 92, 203, 201, 204, 205, 207, 208, 209:
 		h.tail.Write(g)
 	}
 }
@@ -121,7 +123,8 @@ func (h *cfHandler) procSamples() {
 	h.head.Write("info:generating bed level function...")
 	gen, err := bed.Generate(h.samples, h.conf.BedMax)
 	if err != nil {
-		panic(fmt.Sprint("bad bedlevel data", err))
+		h.sup.Fail(newError("config", KindBedLevel, "bad bedlevel data: %v", err))
+		return
 	}
 	h.zFunc = gen
 	h.tail.Write(gen)
@@ -141,45 +144,56 @@ func (h *cfHandler) saveSamples() {
 	bed.SaveSampleFile(h.conf.BedSamplesPath, h.samples)
 }
 
-func ConfigHandler(confPath string) func(_, _ io.Conn) {
-	return func(head, tail io.Conn) {
+func ConfigHandler(confPath string) Handler {
+	return func(sup *Supervisor, head, tail io.Conn) {
 		h := cfHandler{
-			head: head, tail: tail,
+			head: head, tail: tail, sup: sup,
 
 			confReady: make(chan struct{}),
 		}
 
 		if conf, err := config.LoadConfig(confPath); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			sup.Fail(newError("config", KindConfig, "failed to load %v: %v", confPath, err))
+			return
 		} else {
 			h.conf = conf
 			h.tail.Write(conf)
 			h.loadSamples()
 		}
 
-		go func() {
-			for msg := range tail.Rc() {
+		sup.Go(func() {
+			for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
 				h.tailRead(msg)
 			}
-		}()
+			head.Close()
+		})
 
 		// some devices wont restart on connect, so lets
 		// check if active after a little bit.
-		go func() {
-			time.Sleep(readyWaitDelay)
-			tail.Flip().Wc() <- checkActiveMagic
-		}()
+		sup.Go(func() {
+			select {
+			case <-time.After(readyWaitDelay):
+				tail.Flip().Write(checkActiveMagic)
+			case <-h.confReady:
+			case <-sup.Context().Done():
+			}
+		})
 
 		// delay sending upstream until ready
 		select {
 		case <-h.confReady: // wait for device config to be ready
 		case <-time.After(devSettingsTimeout):
-			panic("Failed to load device settings")
+			sup.Fail(newError("config", KindSettingsTimeout, "failed to load device settings"))
+			return
+		case <-sup.Fault():
+			return
+		case <-sup.Context().Done():
+			return
 		}
 
-		for msg := range head.Rc() {
+		for msg, ok := head.Read(); ok; msg, ok = head.Read() {
 			h.headRead(msg)
 		}
+		tail.Close()
 	}
 }
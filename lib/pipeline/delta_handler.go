@@ -2,48 +2,174 @@ package pipeline
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/colinrgodsey/cartesius/f64"
+	"github.com/colinrgodsey/step-daemon/lib/config"
 	"github.com/colinrgodsey/step-daemon/lib/gcode"
 	"github.com/colinrgodsey/step-daemon/lib/io"
 	"github.com/colinrgodsey/step-daemon/lib/physics"
 	"github.com/colinrgodsey/step-daemon/lib/vec"
 )
 
-const syncTimeout = 10 * 60 // seconds
+const (
+	syncTimeout = 10 * 60 // seconds
+
+	// defaultArcTolerance is used if the config does not set an arc tolerance.
+	defaultArcTolerance = 0.01
+
+	mmPerInch = 25.4
+
+	// args given in the active units, for each kind of move
+	moveArgs   = "XYZEF"
+	arcArgs    = moveArgs + "IJKR"
+	splineArgs = moveArgs + "IJPQ"
+
+	// E only moves within these lengths are retracts with M209 S1
+	minAutoRetract = 0.1
+	maxAutoRetract = 10
+)
+
+// retractSettings are the firmware retraction settings, set by M207, M208
+// and M209. Lengths are in mm, and feedrates in mm/s.
+type retractSettings struct {
+	length, swapLength, fr, zHop float64 // M207
+	extra, swapExtra, recoverFr  float64 // M208
+	auto                         bool    // M209
+}
+
+// defaultRetraction are the Marlin defaults.
+var defaultRetraction = retractSettings{
+	length: 3, swapLength: 13, fr: 45,
+	recoverFr: 8,
+}
 
 type deltaHandler struct {
 	head, tail io.Conn
-	syncC      chan vec.Vec4
+	sup        *Supervisor
+	syncC      chan string
 
 	pos         vec.Vec4
 	fr, frScale float64
-	abs         bool
+	abs, absE   bool    // XYZ and E positioning
+	units       float64 // mm per unit, set by G20 and G21
+
+	// work coordinates are offset from the machine coordinates (pos) by the
+	// offset of the active coordinate system (G54-G59.3) and the G92 offset
+	coords   [len(coordNames)]vec.Vec4
+	coordSys int
+	offs     vec.Vec4
+
+	// firmware retraction (G10 and G11) adds its Z hop and E travel to the
+	// machine position, without changing the work coordinates
+	retraction         retractSettings
+	retracted, swapped bool
+	retractOffs        vec.Vec4
+	maxV               vec.Vec4 // for the Z hop
+
+	plane        physics.ArcPlane
+	arcTolerance float64
+
+	acc         vec.Vec4 // for the curvature limit of splines
+	splineC2    f64.Vec2 // last control point of the last spline, from its end
+	afterSpline bool
 }
 
 func (h *deltaHandler) headRead(msg io.Any) {
 	switch msg := msg.(type) {
 	case gcode.GCode:
+		afterSpline := h.afterSpline
+		h.afterSpline = false
 		switch {
 		case msg.IsG(0), msg.IsG(1): // move
-			h.procGMove(msg)
+			h.procGMove(h.toMM(msg, moveArgs), false)
+			return
+		case msg.IsG(53): // move in machine coords
+			h.procG53(msg)
+			return
+		case msg.IsG(10) && msg.Args.Has('L'): // set work offset
+			h.setCoords(h.toMM(msg, "XYZ"))
+			return
+		case msg.IsG(10): // retract
+			swap, _ := msg.Args.GetInt('S')
+			h.retract(swap == 1)
+			return
+		case msg.IsG(11): // recover
+			h.recover()
+			return
+		case msg.IsM(207), msg.IsM(208): // set retraction
+			h.setRetraction(h.toMM(msg, "SWZF"))
 			return
+		case msg.IsM(209): // set auto-retract
+			h.setRetraction(msg)
+			return
+		case isCoordSystem(msg): // select coordinate system
+			h.coordSys = msg.CommandCode - 54 + msg.SubCode
+			h.info("selected coordinate system %v", coordNames[h.coordSys])
+			return
+		case msg.IsGSub(92, 1): // reset G92 offset
+			h.offs = vec.Vec4{}
+			return
+		case msg.IsG(2), msg.IsG(3): // arc move
+			h.procGArc(h.toMM(msg, arcArgs))
+			return
+		case msg.IsG(5): // spline move
+			h.procGSpline(h.toMM(msg, splineArgs), afterSpline)
+			return
+		case msg.IsG(20): // set inch units
+			h.info("setting units to inches")
+			h.units = mmPerInch
+			return
+		case msg.IsG(21): // set mm units
+			h.info("setting units to mm")
+			h.units = 1
+			return
+		case msg.IsG(17): // select plane
+			h.plane = physics.PlaneXY
+		case msg.IsG(18):
+			h.plane = physics.PlaneZX
+		case msg.IsG(19):
+			h.plane = physics.PlaneYZ
 		case msg.IsG(28): // home
-			defer h.headRead(gcode.New('M', 114)) // get pos after
+			h.retractOffs = vec.NewVec4(0, 0, 0, h.retractOffs.E()) // no more Z hop
+			defer h.headRead(gcode.New('M', 114))                   // get pos after
 		case msg.IsG(29): // z probe
 			defer h.headRead(gcode.New('G', 28)) // home after
 		case msg.IsG(90): // set absolute
 			h.info("setting to absolute coords")
-			h.abs = true
+			h.abs, h.absE = true, true
 		case msg.IsG(91): // set relative
 			h.info("setting to relative coords")
-			h.abs = false
+			h.abs, h.absE = false, false
+		case msg.IsM(82): // set absolute extrusion
+			h.info("setting to absolute extrusion")
+			h.absE = true
+		case msg.IsM(83): // set relative extrusion
+			h.info("setting to relative extrusion")
+			h.absE = false
 		case msg.IsG(92): // set pos
-			h.pos = msg.Args.GetVec4(h.pos)
+			// XYZ sets the G92 offset, E resets the machine position
+			msg = h.toMM(msg, "XYZE")
+			other := h.workOffs().Sub(h.offs)
+			h.offs = setAxes(h.offs, msg.Args, func(i int, x float64) float64 {
+				return h.pos.GetAt(i) - x - other.GetAt(i)
+			})
+			e, ok := msg.Args.GetFloat('E')
+			if !ok {
+				return
+			}
+			h.pos = vec.NewVec4(h.pos.X(), h.pos.Y(), h.pos.Z(), e)
+			h.retractOffs = vec.NewVec4(0, 0, h.retractOffs.Z(), 0)
+			msg.Args = gcode.Args{gcode.Arg('E', e)}
+		case msg.IsM(201): // set max accel
+			h.acc = msg.Args.GetVec4(h.acc)
+		case msg.IsM(203): // set max vel
+			h.maxV = msg.Args.GetVec4(h.maxV)
 		case msg.IsM(114): // get pos
-			c := make(chan vec.Vec4)
+			c := make(chan string, 1)
 			h.syncC = c
 			defer h.getPos(c)
 		case msg.IsM(220): // set feedrate
@@ -52,35 +178,23 @@ func (h *deltaHandler) headRead(msg io.Any) {
 				h.info("setting feedrate scale to %v", h.frScale)
 			}
 		}
+	case config.Config:
+		h.arcTolerance = msg.ArcTolerance
+		if h.arcTolerance <= 0 {
+			h.arcTolerance = defaultArcTolerance
+		}
 	}
 	h.tail.Write(msg)
 }
 
 func (h *deltaHandler) tailRead(msg io.Any) {
-	bailParse := func(err error) {
-		if err != nil {
-			panic("Failed to parse string: " + err.Error())
-		}
-	}
-
 	switch msg := msg.(type) {
 	case string:
 		switch {
 		case strings.Index(msg, "X:") == 0 && strings.Index(msg, " Count ") > 0:
-			// X:0.00 Y:0.00 Z:10.00 E:0.00 Count X:0 Y:0 Z:16000
-			spl := strings.Split(msg, " ")
-			x, err := strconv.ParseFloat(string(spl[0][2:]), 64)
-			bailParse(err)
-			y, err := strconv.ParseFloat(string(spl[1][2:]), 64)
-			bailParse(err)
-			z, err := strconv.ParseFloat(string(spl[2][2:]), 64)
-			bailParse(err)
-			e, err := strconv.ParseFloat(string(spl[3][2:]), 64)
-			bailParse(err)
-
 			//TODO: still not happy about this pattern
 			if h.syncC != nil {
-				h.syncC <- vec.NewVec4(x, y, z, e)
+				h.syncC <- msg
 				h.syncC = nil
 			}
 			return
@@ -89,32 +203,186 @@ func (h *deltaHandler) tailRead(msg io.Any) {
 	h.head.Write(msg)
 }
 
+// parsePos parses the position reported by the device for M114.
+func parsePos(line string) (vec.Vec4, error) {
+	// X:0.00 Y:0.00 Z:10.00 E:0.00 Count X:0 Y:0 Z:16000
+	var vs [4]float64
+	spl := strings.Split(line, " ")
+	for i := range vs {
+		var err error
+		if vs[i], err = strconv.ParseFloat(string(spl[i][2:]), 64); err != nil {
+			return vec.Vec4{}, err
+		}
+	}
+	return vec.NewVec4(vs[:]...), nil
+}
+
+// getPos waits for the device position and syncs to it, then reports
+// it upstream in the active units.
 //TODO: i hate this, replace this later
-func (h *deltaHandler) getPos(c <-chan vec.Vec4) {
+func (h *deltaHandler) getPos(c <-chan string) {
 	h.info("syncing with device position")
 	select {
-	case pos := <-c:
+	case line := <-c:
+		pos, err := parsePos(line)
+		if err != nil {
+			h.sup.Fail(newError("delta", KindProtocol, "failed to parse position %q: %v", line, err))
+			return
+		}
 		h.info("syncd with device position")
-		h.headRead(gcode.New('G', 92, gcode.ArgV(pos)...))
+		h.pos = pos
+		h.tail.Write(gcode.New('G', 92, gcode.ArgV(pos)...))
+
+		prec := 2
+		if h.units != 1 {
+			prec = 4
+		}
+		p := pos.Sub(h.workOffs()).Mul(1 / h.units)
+		h.head.Write(fmt.Sprintf("X:%.*f Y:%.*f Z:%.*f E:%.*f%v", prec, p.X(), prec, p.Y(),
+			prec, p.Z(), prec, p.E(), line[strings.Index(line, " Count "):]))
 	case <-time.After(syncTimeout * time.Second):
-		panic("timed out while syncing position")
+		h.sup.Fail(newError("delta", KindSyncTimeout, "timed out while syncing position"))
+	case <-h.sup.Fault():
+	case <-h.sup.Context().Done():
 	}
 }
 
-func (h *deltaHandler) procGMove(g gcode.GCode) {
-	var newPos vec.Vec4
-	if h.abs {
-		newPos = g.Args.GetVec4(h.pos)
-	} else {
-		newPos = g.Args.GetVec4(vec.Vec4{}).Add(h.pos)
+// toMM converts the lengths in the given args of g from the active units to mm.
+func (h *deltaHandler) toMM(g gcode.GCode, lengths string) gcode.GCode {
+	if h.units == 1 {
+		return g
+	}
+	args := make(gcode.Args, len(g.Args))
+	for i, arg := range g.Args {
+		args[i] = arg
+		if len(arg) > 1 && strings.IndexByte(lengths, arg[0]) >= 0 {
+			if x, err := strconv.ParseFloat(arg[1:], 64); err == nil {
+				args[i] = arg[:1] + strconv.FormatFloat(x*h.units, 'f', -1, 64)
+			}
+		}
 	}
+	g.Args = args
+	return g
+}
+
+var coordNames = [...]string{"G54", "G55", "G56", "G57", "G58", "G59", "G59.1", "G59.2", "G59.3"}
+
+// isCoordSystem returns true for G54-G59.3.
+func isCoordSystem(g gcode.GCode) bool {
+	switch {
+	case g.CommandType != 'G':
+		return false
+	case g.CommandCode >= 54 && g.CommandCode <= 58:
+		return g.SubCode == 0
+	}
+	return g.CommandCode == 59 && g.SubCode <= 3
+}
+
+// workOffs returns the offset of the work coordinates from the machine.
+func (h *deltaHandler) workOffs() vec.Vec4 {
+	return h.coords[h.coordSys].Add(h.offs).Add(h.retractOffs)
+}
+
+// setAxes returns v with each XYZ axis given in args set to f of its value.
+func setAxes(v vec.Vec4, args gcode.Args, f func(i int, x float64) float64) vec.Vec4 {
+	var res [4]float64
+	for i, axis := range "XYZE" {
+		res[i] = v.GetAt(i)
+		if x, ok := args.GetFloat(axis); ok && i < 3 {
+			res[i] = f(i, x)
+		}
+	}
+	return vec.NewVec4(res[:]...)
+}
+
+/*
+setCoords sets the offset of a coordinate system with G10. L2 sets the
+offset from the machine coordinates, and L20 sets it so the current position
+is at the given work coordinates. P1-P9 select G54-G59.3, or P0 for the
+active system.
+*/
+func (h *deltaHandler) setCoords(g gcode.GCode) {
+	l, _ := g.Args.GetInt('L')
+	p, _ := g.Args.GetInt('P')
+	i := p - 1
+	if p == 0 {
+		i = h.coordSys
+	}
+	if (l != 2 && l != 20) || i < 0 || i >= len(h.coords) {
+		h.head.Write(fmt.Sprintf("error:invalid work offset %v", g))
+		return
+	}
+	h.coords[i] = setAxes(h.coords[i], g.Args, func(j int, x float64) float64 {
+		if l == 2 {
+			return x
+		}
+		return h.pos.GetAt(j) - x - h.offs.GetAt(j) - h.retractOffs.GetAt(j)
+	})
+	h.info("setting %v offset to %v", coordNames[i], h.coords[i])
+}
+
+// procG53 runs the G0 or G1 move on the same line in machine coordinates.
+func (h *deltaHandler) procG53(g gcode.GCode) {
+	code, ok := g.Args.GetInt('G')
+	if !ok || (code != 0 && code != 1) {
+		h.info("ignored G53 without a move")
+		return
+	}
+	var args gcode.Args
+	for _, arg := range g.Args {
+		if arg[0] != 'G' {
+			args = append(args, arg)
+		}
+	}
+	h.procGMove(h.toMM(gcode.New('G', code, args...), moveArgs), true)
+}
+
+/*
+target returns the end position of a move in machine coordinates, and
+updates the fr. Positions are given in work coordinates, or machine
+coordinates (always absolute) for G53. E is positioned separately from
+XYZ, as set by M82 and M83.
+*/
+func (h *deltaHandler) target(g gcode.GCode, machine bool) vec.Vec4 {
 	if f, ok := g.Args.GetFloat('F'); ok {
 		h.fr = f * h.frScale / 60.0
 	}
+	offs := h.workOffs()
+	if machine {
+		offs = vec.Vec4{}
+	}
+	abs := g.Args.GetVec4(h.pos.Sub(offs)).Add(offs)
+	pos := g.Args.GetVec4(vec.Vec4{}).Add(h.pos)
+	if h.abs || machine {
+		pos = vec.NewVec4(abs.X(), abs.Y(), abs.Z(), pos.E())
+	}
+	if h.absE {
+		pos = vec.NewVec4(pos.X(), pos.Y(), pos.Z(), abs.E())
+	}
+	return pos
+}
+
+func (h *deltaHandler) procGMove(g gcode.GCode, machine bool) {
+	newPos := h.target(g, machine)
 	if newPos.Eq(h.pos) {
 		return
 	}
 
+	// E only moves may be retracts, as in Marlin
+	if h.retraction.auto && !machine && !g.Args.Has('X') && !g.Args.Has('Y') && !g.Args.Has('Z') {
+		de := newPos.E() - h.pos.E()
+		if math.Abs(de) >= minAutoRetract && math.Abs(de) <= maxAutoRetract && h.retracted == (de > 0) {
+			// the E position is taken, without moving
+			h.retractOffs = h.retractOffs.Sub(vec.NewVec4(0, 0, 0, de))
+			if de < 0 {
+				h.retract(false)
+			} else {
+				h.recover()
+			}
+			return
+		}
+	}
+
 	m := physics.NewMove(h.pos, newPos, h.fr)
 	h.pos = newPos
 	if h.fr != 0 {
@@ -124,23 +392,222 @@ func (h *deltaHandler) procGMove(g gcode.GCode) {
 	}
 }
 
+/*
+procGArc splits a G2 (clockwise) or G3 (counter-clockwise) arc into chord
+moves, within the arc tolerance. The center is given as an offset from the
+current position (I, J and K for X, Y and Z), or by the radius (R). The axis
+outside of the plane and E move linearly along the arc, as a helix.
+*/
+func (h *deltaHandler) procGArc(g gcode.GCode) {
+	cw := g.IsG(2)
+	newPos := h.target(g, false)
+
+	var center vec.Vec4
+	if r, ok := g.Args.GetFloat('R'); ok {
+		var err error
+		if center, err = physics.ArcCenter(h.pos, newPos, r, h.plane, cw); err != nil {
+			h.head.Write(fmt.Sprintf("error:invalid arc %v (%v)", g, err))
+			return
+		}
+	} else {
+		var offs [4]float64
+		for i, axis := range "IJK" {
+			offs[i], _ = g.Args.GetFloat(axis)
+		}
+		if offs[h.plane[0]] == 0 && offs[h.plane[1]] == 0 {
+			h.head.Write(fmt.Sprintf("error:invalid arc %v (no center)", g))
+			return
+		}
+		center = h.pos.Add(vec.NewVec4(offs[:]...))
+	}
+
+	if h.fr == 0 {
+		h.pos = newPos
+		h.info("skipped move with 0 feedrate")
+		return
+	}
+	chords := physics.Arc(h.pos, newPos, center, h.plane, cw, h.arcTolerance)
+	for i, pos := range chords {
+		h.pathMove(pos, h.fr, i == len(chords)-1)
+	}
+}
+
+// pathMove moves to pos along a curve. Each chord but the last is sent
+// as a PathMove, so the curve does not stop at each chord.
+func (h *deltaHandler) pathMove(pos vec.Vec4, fr float64, last bool) {
+	if pos.Eq(h.pos) {
+		return
+	}
+	move := physics.NewMove(h.pos, pos, fr)
+	if last {
+		h.tail.Write(move)
+	} else {
+		h.tail.Write(PathMove{move})
+	}
+	h.pos = pos
+}
+
+/*
+procGSpline splits a G5 cubic Bezier spline into chord moves of equal
+length, within the arc tolerance. The first control point is given as an
+offset from the current position (I, J), and the second as an offset from
+the end position (P, Q). If I and J are left out after another spline, the
+first control point mirrors the last one, for a smooth join. The fr of each
+chord is limited so the centripetal acceleration through the curve stays
+within the X and Y acceleration limits.
+*/
+func (h *deltaHandler) procGSpline(g gcode.GCode, afterSpline bool) {
+	newPos := h.target(g, false)
+
+	var offs [4]float64
+	for i, axis := range "IJPQ" {
+		offs[i], _ = g.Args.GetFloat(axis)
+	}
+	c1 := f64.Vec2(h.pos.XY()).Add(f64.Vec2{offs[0], offs[1]})
+	switch {
+	case !g.Args.Has('P') || !g.Args.Has('Q'):
+		h.head.Write(fmt.Sprintf("error:invalid spline %v (P and Q are required)", g))
+		return
+	case !g.Args.Has('I') && !g.Args.Has('J'):
+		if !afterSpline {
+			h.head.Write(fmt.Sprintf("error:invalid spline %v (I and J are required)", g))
+			return
+		}
+		c1 = f64.Vec2(h.pos.XY()).Sub(h.splineC2)
+	}
+	c2 := f64.Vec2(newPos.XY()).Add(f64.Vec2{offs[2], offs[3]})
+	h.splineC2 = f64.Vec2{offs[2], offs[3]}
+	h.afterSpline = true
+
+	if h.fr == 0 {
+		h.pos = newPos
+		h.info("skipped move with 0 feedrate")
+		return
+	}
+	acc := math.Min(h.acc.X(), h.acc.Y())
+	chords := physics.Spline(h.pos, newPos, c1, c2, h.arcTolerance)
+	for i, p := range chords {
+		fr := h.fr
+		if acc > 0 && p.Curvature > 0 {
+			fr = math.Min(fr, math.Sqrt(acc/p.Curvature))
+		}
+		h.pathMove(p.Pos, fr, i == len(chords)-1)
+	}
+}
+
+// setRetraction updates the firmware retraction settings from M207, M208 or M209.
+func (h *deltaHandler) setRetraction(g gcode.GCode) {
+	r := &h.retraction
+	get := func(a rune, x *float64, scale float64) {
+		if f, ok := g.Args.GetFloat(a); ok {
+			*x = f * scale
+		}
+	}
+	switch {
+	case g.IsM(207):
+		get('S', &r.length, 1)
+		get('W', &r.swapLength, 1)
+		get('F', &r.fr, 1/60.0)
+		get('Z', &r.zHop, 1)
+	case g.IsM(208):
+		get('S', &r.extra, 1)
+		get('W', &r.swapExtra, 1)
+		get('F', &r.recoverFr, 1/60.0)
+	case g.IsM(209):
+		if i, ok := g.Args.GetInt('S'); ok {
+			r.auto = i != 0
+		}
+	}
+}
+
+// retractMove moves to the machine position, as part of a retract or recover.
+func (h *deltaHandler) retractMove(pos vec.Vec4, fr float64) {
+	if fr > 0 && !pos.Eq(h.pos) {
+		h.tail.Write(physics.NewMove(h.pos, pos, fr))
+	}
+	h.pos = pos
+}
+
+/*
+retract pulls the filament back by the retract length (or the swap length
+for G10 S1), then lifts Z by the Z hop at the max Z fr. The E and Z travel
+are kept out of the work coordinates, so the G-code positions are unchanged.
+*/
+func (h *deltaHandler) retract(swap bool) {
+	if h.retracted {
+		return
+	}
+	length := h.retraction.length
+	if swap {
+		length = h.retraction.swapLength
+	}
+	de := vec.NewVec4(0, 0, 0, -length)
+	h.retractMove(h.pos.Add(de), h.retraction.fr)
+	h.retractOffs = h.retractOffs.Add(de)
+
+	if hop := h.retraction.zHop; hop > 0 {
+		dz := vec.NewVec4(0, 0, hop, 0)
+		h.retractMove(h.pos.Add(dz), h.hopFr())
+		h.retractOffs = h.retractOffs.Add(dz)
+	}
+	h.retracted, h.swapped = true, swap
+}
+
+// recover drops the Z hop, then pushes the filament back by the retract
+// length and the recover extra length.
+func (h *deltaHandler) recover() {
+	if !h.retracted {
+		return
+	}
+	if hop := h.retractOffs.Z(); hop != 0 {
+		dz := vec.NewVec4(0, 0, -hop, 0)
+		h.retractMove(h.pos.Add(dz), h.hopFr())
+		h.retractOffs = h.retractOffs.Add(dz)
+	}
+
+	length := h.retraction.length + h.retraction.extra
+	if h.swapped {
+		length = h.retraction.swapLength + h.retraction.swapExtra
+	}
+	de := vec.NewVec4(0, 0, 0, length)
+	h.retractMove(h.pos.Add(de), h.retraction.recoverFr)
+	h.retractOffs = h.retractOffs.Add(de)
+	h.retracted, h.swapped = false, false
+}
+
+// hopFr is the fr of the Z hop.
+func (h *deltaHandler) hopFr() float64 {
+	if z := h.maxV.Z(); z > 0 {
+		return z
+	}
+	return h.retraction.fr
+}
+
 func (h *deltaHandler) info(s string, args ...interface{}) {
 	h.head.Write(fmt.Sprintf("info:"+s, args...))
 }
 
-func DeltaHandler(head, tail io.Conn) {
+func DeltaHandler(sup *Supervisor, head, tail io.Conn) {
 	h := deltaHandler{
-		head: head, tail: tail,
+		head: head, tail: tail, sup: sup,
 		frScale: 1.0,
+		units:   1.0,
+
+		retraction: defaultRetraction,
+
+		plane:        physics.PlaneXY,
+		arcTolerance: defaultArcTolerance,
 	}
 
-	go func() {
-		for msg := range tail.Rc() {
+	sup.Go(func() {
+		for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
 			h.tailRead(msg)
 		}
-	}()
+		head.Close()
+	})
 
-	for msg := range head.Rc() {
+	for msg, ok := head.Read(); ok; msg, ok = head.Read() {
 		h.headRead(msg)
 	}
+	tail.Close()
 }
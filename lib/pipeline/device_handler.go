@@ -26,19 +26,31 @@ type pagePlaceholder int
 
 type pageState byte
 
+// safeStopCommands put the device in a safe state after a fault.
+var safeStopCommands = [...]gcode.GCode{
+	gcode.New('M', 410),       // quick-stop
+	gcode.New('M', 104, "S0"), // hotend off
+	gcode.New('M', 140, "S0"), // bed off
+}
+
 type deviceHandler struct {
 	head, tail io.Conn
+	sup        *Supervisor
 
-	q      list.List
-	states [NumPages]pageState
-	pages  [NumPages]PageData
+	q       list.List
+	states  [NumPages]pageState
+	pages   [NumPages]PageData
+	running [NumPages]bool // sent with G6, and not yet freed
 
 	pendingCommands int
+	awaiting        []gcode.GCode // sent commands waiting for their ok
 	n               int
 
 	hasSent   bool
 	lastDirs  [4]bool
 	lastSpeed int
+
+	faulted, draining bool
 }
 
 var validTransitions = [...][]pageState{
@@ -58,6 +70,9 @@ func transValid(from, to pageState) bool {
 }
 
 func (h *deviceHandler) headRead(msg io.Any) {
+	if h.faulted {
+		return // discard everything after a fault
+	}
 	switch msg := msg.(type) {
 	case PageData:
 		h.pushPage(msg)
@@ -75,17 +90,28 @@ func (h *deviceHandler) tailRead(msg io.Any) {
 		h.updatePageStates(msg)
 	case string:
 		if strings.Index(msg, "ok") == 0 {
+			var g gcode.GCode
+			if len(h.awaiting) > 0 {
+				g, h.awaiting = h.awaiting[0], h.awaiting[1:]
+			}
+			if g.IsM(503) {
+				h.head.Write(msg) // ends the settings, see ConfigHandler
+			}
 			h.pendingCommands--
 			if h.pendingCommands < 0 {
 				h.head.Write("warn:pending OK count dropped below 0")
 				h.pendingCommands = 0
 			}
 			//h.head.Write("debug:" + msg)
+			if h.faulted && h.pendingCommands == 0 {
+				h.sup.markSafe()
+			}
 		} else {
 			h.head.Write(msg)
 		}
 	default:
-		panic("unknown message type")
+		h.sup.Fail(newError("device", KindProtocol, "unknown message type %T", msg))
+		return
 	}
 	h.drain()
 }
@@ -100,7 +126,14 @@ func (h *deviceHandler) drain() {
 			}
 			h.sendG6(msg)
 		case gcode.GCode:
-			h.sendGCode(msg)
+			if isSync(msg) && h.pagesRunning() {
+				return // block queue until the pages before have run
+			}
+			if msg.IsM(400) {
+				h.head.Write(Synced{})
+			} else {
+				h.sendGCode(msg)
+			}
 		case string:
 			h.tail.Write(msg)
 		}
@@ -119,6 +152,7 @@ func (h *deviceHandler) sendGCode(g gcode.GCode) {
 	//h.head.Write("debug:send " + str)
 	h.tail.Write(str)
 	h.pendingCommands++
+	h.awaiting = append(h.awaiting, g)
 }
 
 func (h *deviceHandler) updatePageStates(msg []byte) {
@@ -131,6 +165,7 @@ func (h *deviceHandler) updatePageStates(msg []byte) {
 			continue
 		}
 		switch {
+		case s0 == pFail && s1 == pFree && h.faulted:
 		case s0 == pFail && s1 == pFree:
 			h.sendPage(i) // resend
 			continue      // dont set free state
@@ -139,6 +174,7 @@ func (h *deviceHandler) updatePageStates(msg []byte) {
 			h.sendUnlock(i)
 		case s1 == pFree:
 			h.pages[i] = PageData{} // clear
+			h.running[i] = false
 		}
 		h.states[i] = s1
 	}
@@ -158,7 +194,8 @@ func (h *deviceHandler) pushPage(msg PageData) {
 	nFree, idx := h.freePages()
 
 	if nFree == 0 {
-		panic("Page management failed to find a free page")
+		h.sup.Fail(newError("device", KindPageOverflow, "page management failed to find a free page"))
+		return
 	}
 
 	h.pages[idx] = msg
@@ -233,10 +270,47 @@ func (h *deviceHandler) sendG6(idx pagePlaceholder) {
 	h.lastSpeed = page.Speed
 	h.lastDirs = page.Dirs
 	h.hasSent = true
+	h.running[idx] = true
 	h.sendGCode(gcode.New('G', 6, args...))
 }
 
+// isSync is true for commands that run after the pages before them, G4 and M400.
+func isSync(g gcode.GCode) bool {
+	return g.IsG(4) || g.IsM(400)
+}
+
+// pagesRunning is true until all pages sent with G6 have run.
+func (h *deviceHandler) pagesRunning() bool {
+	for _, r := range h.running {
+		if r {
+			return true
+		}
+	}
+	return false
+}
+
+// safeStop discards all pending pages and commands, and stops the device.
+func (h *deviceHandler) safeStop() {
+	h.faulted = true
+	h.q.Init()
+	for _, g := range safeStopCommands {
+		h.sendGCode(g)
+	}
+}
+
+// drained is true once all pages and commands have been run by the device.
+func (h *deviceHandler) drained() bool {
+	nFree, _ := h.freePages()
+	return h.q.Len() == 0 && h.pendingCommands == 0 && nFree == NumPages
+}
+
 func (h *deviceHandler) shouldRead() bool {
+	if h.draining {
+		return false
+	}
+	if h.faulted {
+		return true
+	}
 	if h.pendingCommands >= MaxPendingCommands {
 		return false
 	}
@@ -244,19 +318,35 @@ func (h *deviceHandler) shouldRead() bool {
 	return nFree > 0
 }
 
-func DeviceHandler(head, tail io.Conn) {
-	h := deviceHandler{head: head, tail: tail, n: maxN}
+func DeviceHandler(sup *Supervisor, head, tail io.Conn) {
+	h := deviceHandler{head: head, tail: tail, sup: sup, n: maxN}
+	fault := sup.Fault()
 
-	for {
-		if h.shouldRead() {
-			select {
-			case msg := <-head.Rc():
-				h.headRead(msg)
-			case msg := <-tail.Rc():
-				h.tailRead(msg)
+	for !h.draining || !h.drained() {
+		headC := head.Rc()
+		if !h.shouldRead() {
+			headC = nil
+		}
+		select {
+		case msg := <-headC:
+			if io.IsClosed(msg) {
+				h.draining = true
+				continue
 			}
-		} else {
-			h.tailRead(<-tail.Rc())
+			h.headRead(msg)
+		case msg := <-tail.Rc():
+			if io.IsClosed(msg) {
+				head.Close() // device is gone
+				return
+			}
+			h.tailRead(msg)
+		case <-fault:
+			fault = nil
+			h.safeStop()
+		case <-sup.Context().Done():
+			return
 		}
 	}
+	tail.Close()
+	head.Close()
 }
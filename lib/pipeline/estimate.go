@@ -0,0 +1,59 @@
+package pipeline
+
+// Layer is the time spent on a single layer of a print.
+type Layer struct {
+	Z    float64 `json:"z"`
+	Time float64 `json:"time"`
+}
+
+// Estimate is the print time and filament use of the planned motion.
+type Estimate struct {
+	Time     float64 `json:"time"`     // seconds
+	Filament float64 `json:"filament"` // mm of filament extruded
+	Layers   []Layer `json:"layers"`
+
+	Blocks          int `json:"blocks"`
+	Resized         int `json:"resized"`
+	SCurveFallbacks int `json:"s-curve-fallbacks"`
+
+	preTime float64 // time before the first layer
+}
+
+/*
+Add a planned block to the estimate. Layers start with the first print
+move at a new height. Any time spent before the first layer is counted
+towards it.
+*/
+func (est *Estimate) Add(block PlannedBlock) {
+	move := block.GetMove()
+	dt := block.GetShape().Dt()
+
+	est.Blocks++
+	est.Time += dt
+	est.Filament += move.Delta().E()
+	if block.Resized {
+		est.Resized++
+	}
+	if block.SCurveFallback {
+		est.SCurveFallbacks++
+	}
+
+	z := move.From().Z()
+	if n := len(est.Layers); move.IsPrintMove() && (n == 0 || est.Layers[n-1].Z != z) {
+		est.Layers = append(est.Layers, Layer{Z: z})
+		if n == 0 {
+			dt += est.preTime
+		}
+	}
+	if n := len(est.Layers); n > 0 {
+		est.Layers[n-1].Time += dt
+	} else {
+		est.preTime += dt
+	}
+}
+
+// EstimateHandler adds each planned block to est, see BlockHandler.
+// The estimate is complete once the pipeline is closed.
+func EstimateHandler(settings []string, est *Estimate) Handler {
+	return BlockHandler(settings, est.Add)
+}
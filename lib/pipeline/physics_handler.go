@@ -12,44 +12,83 @@ import (
 )
 
 const (
-	maxLimitResize  = 30
-	maxSCurveResize = 30
-	maxNormResize   = 100
-	resizeScale     = 0.8
+	// defaultLookahead is used if the config does not set a lookahead.
+	defaultLookahead = 16
+
+	// junctionEps is the margin used to find straight or reversing junctions.
+	junctionEps = 1e-6
+
+	// Moves with fewer segments or steps than these are too short for
+	// the shape of their easing to matter, and use a single pulse block.
+	minShapedSegments = 4
+	minShapedSteps    = 16
 
 	failedSCurve = "warn:failed to apply s-curve easing"
 )
 
 type physicsHandler struct {
 	head, tail io.Conn
+	sup        *Supervisor
 
 	sJerk, acc vec.Vec4
 	spmm, maxV vec.Vec4
+	retractAcc float64 // for E only moves
+
+	sps, segRate float64
+	maxSV        vec.Vec4
+	kin          physics.Kinematics
+
+	cornering   string
+	junctionDev float64
+
+	lookahead int
+	moves     []plannedMove
+	continued bool // the last move is continued by the next, see PathMove
+}
 
-	sps   float64
-	maxSV vec.Vec4
+// plannedMove is a move waiting in the lookahead buffer.
+type plannedMove struct {
+	physics.Move
 
-	lastMove, curMove physics.Move
+	acc, jerk float64 // along the move
+	maxStart  float64 // junction limit with the previous move
+	frStart   float64 // planned start fr
+	resized   bool    // slowed down by limitResize
 }
 
 func (h *physicsHandler) headRead(msg io.Any) {
 	switch msg := msg.(type) {
 	case physics.Move:
-		if !msg.IsPrintMove() {
-			h.endBlock()
-			h.procMove(msg)
-			h.endBlock()
-		} else {
-			h.procMove(msg)
+		if err := h.procPathMove(msg, false); err != nil {
+			h.sup.Fail(err)
+		}
+		return
+	case PathMove:
+		if err := h.procPathMove(msg.Move, true); err != nil {
+			h.sup.Fail(err)
 		}
 		return
 	case gcode.GCode:
-		h.endBlock()
+		h.continued = false
+		if err := h.endBlock(); err != nil {
+			h.sup.Fail(err)
+			return
+		}
 		switch {
 		case msg.IsM(201): // set max accel
 			h.acc = msg.Args.GetVec4(h.acc)
+		case msg.IsM(204): // set retract accel
+			if f, ok := msg.Args.GetFloat('R'); ok {
+				h.retractAcc = f
+			}
 		case msg.IsM(203): // set max vel
 			h.maxV = msg.Args.GetVec4(h.maxV)
+		case msg.IsM(205): // set junction deviation
+			if f, ok := msg.Args.GetFloat('J'); ok && f > 0 {
+				h.junctionDev = f
+			} else if ok {
+				h.head.Write(fmt.Sprintf("warn:ignored junction deviation J%v", f))
+			}
 		case msg.IsM(92): // set steps/mm
 			h.spmm = msg.Args.GetVec4(h.spmm)
 			h.maxSV = h.spmm.Inv().Mul(h.sps)
@@ -62,191 +101,302 @@ func (h *physicsHandler) headRead(msg io.Any) {
 }
 
 /*
-Use the inner (dot) product of the 4d vectors to determine jerk, accel, and junction feed rate.
-For the junction fr, the dot product of the 2 movement vectors is taken, and clamped to [0, 1].
-The will produce a junction of 0 for any angles that are 90* or more.
-Jerk is calculated by setting a floor based on the dot product of the change in velocity vectors,
-if below this floor, the junction fr is 100% of the smaller of either fr (no accel).
-Acceleration is calculated as the dot product of the movement vector (normalized absolute)
-and the acceleration vector. Because both of these have positive-only values for each dimension,
-the dot product produced is between 0 and acc.length. Should never be 0 for real values.
-Invalid pre or post moves force a junction fr of 0.
+Acceleration is the largest path acceleration for which each motor
+stays within its own limit. Jerk is calculated the same way. E only
+moves (retracts) are also limited to the retract acceleration.
+Invalid pre moves force a junction fr of 0.
 */
-func (h *physicsHandler) createBlock(pre, move, post physics.Move, useSTrap bool) (physics.MotionBlock, error) {
-	/*calcJerk := func(x vec.Vec4) float64 {
-		if x.Dist() < physics.Eps {
-			return h.sJerk.Dist()
-		}
-		return x.Abs().Norm().Dot(h.sJerk)
+func (h *physicsHandler) planMove(pre, move physics.Move) plannedMove {
+	m := plannedMove{
+		Move: move,
+		acc:  physics.MotorLimit(h.kin, move.From(), move.To(), h.acc),
+		jerk: physics.MotorLimit(h.kin, move.From(), move.To(), h.sJerk),
+	}
+	if move.IsEOnly() && h.retractAcc > 0 {
+		m.acc = math.Min(m.acc, h.retractAcc)
 	}
-
-	//TODO: consider allowing some overlap in the shapes that are within classic jerk?
-
-	//TODO: classic jerk allowance is broken...
-	dvStart := move.Vel().Sub(pre.Vel())
-	frStartJerk := calcJerk(dvStart)
-	frMaxStart := math.Min(pre.Fr(), move.Fr())
-	frStart := 0.0
 	if pre.NonEmpty() {
-		f := pre.Delta().Norm().Dot(move.Delta().Norm())
-		frStart = frMaxStart * clamp(f)
+		if h.cornering == config.CorneringJunctionDeviation {
+			m.maxStart = h.deviationJunctionFr(pre, move)
+		} else {
+			m.maxStart = h.dotJunctionFr(pre, move)
+		}
 	}
+	return m
+}
 
-	frAccel := move.Delta().Abs().Norm().Dot(h.acc)
-	frJerk := move.Delta().Abs().Norm().Dot(h.sJerk)
+/*
+Use the inner (dot) product of the 4d vectors to determine the junction fr.
+The dot product of the 2 movement vectors is taken, and clamped to [0, 1].
+This will produce a junction of 0 for any angles that are 90* or more.
+*/
+func (h *physicsHandler) dotJunctionFr(pre, move physics.Move) float64 {
+	f := pre.Delta().Norm().Dot(move.Delta().Norm())
+	return math.Min(pre.Fr(), move.Fr()) * clamp(f)
+}
 
-	dvEnd := post.Vel().Sub(move.Vel())
-	frEndJerk := calcJerk(dvEnd)
-	frMaxEnd := math.Min(move.Fr(), post.Fr())
-	frEnd := 0.0
-	if post.NonEmpty() {
-		f := move.Delta().Norm().Dot(post.Delta().Norm())
-		frEnd = frMaxEnd * clamp(f)
+/*
+Use junction deviation to determine the junction fr, as Marlin and grbl do.
+The corner is treated as an arc that deviates at most junctionDev from the
+junction point, and the fr is limited so the centripetal acceleration around
+that arc stays within the acceleration along the junction.
+*/
+func (h *physicsHandler) deviationJunctionFr(pre, move physics.Move) float64 {
+	frMax := math.Min(pre.Fr(), move.Fr())
+	u0, u1 := pre.Delta().Norm(), move.Delta().Norm()
+
+	cosTheta := -u0.Dot(u1)
+	switch {
+	case cosTheta > 1-junctionEps: // full reversal
+		return 0
+	case cosTheta < junctionEps-1: // straight line
+		return frMax
 	}
 
-	frDeccel := -frAccel
+	acc := physics.MotorLimit(h.kin, move.From(), move.From().Add(u1.Sub(u0)), h.acc)
+	sinHalfTheta := math.Sqrt(0.5 * (1 - cosTheta))
+	fr := math.Sqrt(acc * h.junctionDev * sinHalfTheta / (1 - sinHalfTheta))
+	return math.Min(fr, frMax)
+}
 
-	if useSTrap {
-		return physics.STrapBlock(
-			frStart, frStartJerk, frAccel, frJerk, move,
-			frDeccel, frEndJerk, frEnd)
-	}
-	return physics.TrapBlock(
-		frStart, frAccel, move, frDeccel, frEnd)*/
+/*
+replan recalculates the start fr of each buffered move. The first move
+is already committed to by the block sent before it, and the last move
+must be able to stop at the end of the buffer.
 
-	frMaxStart := math.Min(pre.Fr(), move.Fr())
-	frStart := 0.0
-	if pre.NonEmpty() {
-		f := pre.Delta().Norm().Dot(move.Delta().Norm())
-		frStart = frMaxStart * clamp(f)
+The backward pass finds the highest start fr from which each move can
+still slow down to the start of the next. The forward pass then limits
+that to what can be reached by speeding up from the previous move.
+*/
+func (h *physicsHandler) replan() {
+	next := 0.0
+	for i := len(h.moves) - 1; i > 0; i-- {
+		m := &h.moves[i]
+		m.frStart = math.Min(m.maxStart,
+			physics.MaxRampVel(next, m.Delta().Dist(), m.acc, m.jerk))
+		next = m.frStart
 	}
-
-	frAccel := move.Delta().Abs().Norm().Dot(h.acc)
-	frJerk := move.Delta().Abs().Norm().Dot(h.sJerk)
-
-	frMaxEnd := math.Min(move.Fr(), post.Fr())
-	frEnd := 0.0
-	if post.NonEmpty() {
-		f := move.Delta().Norm().Dot(post.Delta().Norm())
-		frEnd = frMaxEnd * clamp(f)
+	for i := 1; i < len(h.moves); i++ {
+		pre, m := &h.moves[i-1], &h.moves[i]
+		m.frStart = math.Min(m.frStart,
+			physics.MaxRampVel(pre.frStart, pre.Delta().Dist(), pre.acc, pre.jerk))
 	}
+}
 
-	if useSTrap {
-		return physics.STrapBlock(
-			frJerk, frAccel, frStart, move, frEnd)
+/*
+isTiny returns true if the move, passing through at the average of its
+start and end fr, is sampled into too few segments or makes too few steps
+for any easing shape to be resolved.
+*/
+func (h *physicsHandler) isTiny(m plannedMove, frEnd float64) bool {
+	frAvg := (m.frStart + frEnd) / 2
+	if !(frAvg > 0) {
+		return false
+	}
+	segments := m.Delta().Dist() / frAvg * h.segRate
+	motors := h.kin.Motors(m.To()).Sub(h.kin.Motors(m.From()))
+	steps := 0.0
+	for i := 0; i < 4; i++ {
+		steps = math.Max(steps, math.Abs(motors.GetAt(i)*h.spmm.GetAt(i)))
 	}
-	return physics.TrapBlock(
-		frAccel, frStart, move, frEnd)
+	return segments < minShapedSegments || steps < minShapedSteps
 }
 
 /*
-This function takes the next move, and comares it to the
-"last" move (has already been sent, can not be modified)
-and "current" move (staged but not sent, can still be modified).
-The "next" move here can also be modified.
+createBlock eases the move between its planned start and end fr. The target
+fr is lowered if the move is too short to reach it. S-curve easing is used
+if there is jerk to work with, otherwise we fall back to a trapezoid, and
+then to a single pulse. Tiny moves just ramp from their start to end fr
+with a single pulse.
+*/
+func (h *physicsHandler) createBlock(m plannedMove, frEnd float64) (PlannedBlock, *Error) {
+	move := m.Move
+	res := PlannedBlock{Resized: m.resized}
+	if h.isTiny(m, frEnd) {
+		move = physics.NewMove(move.From(), move.To(), math.Max(m.frStart, frEnd))
+		if block, err := physics.PulseBlock(m.frStart, move, frEnd); err == nil {
+			res.MotionBlock = block
+			return res, nil
+		}
+	}
 
-A "pre" fault here will slow down the current move, a "post" fault
-here will slow down the next move.
+	fr := physics.MaxCruiseVel(m.frStart, frEnd, move.Fr(), move.Delta().Dist(), m.acc, m.jerk)
+	if fr < move.Fr() {
+		move = physics.NewMove(move.From(), move.To(), fr)
+	}
 
-Slowing the target fr *does not* affect either juction fr.
-*/
-func (h *physicsHandler) procMoveSafe(next physics.Move, maxResizes int, useSTrap bool) (physics.Move, bool) {
-	var block physics.MotionBlock
-	var err error
-
-	curMove := h.curMove
-	if !h.curMove.NonEmpty() {
-		goto success // move is empty, no motion block needed
-	}
-
-	for i := 0; i < maxResizes; i++ {
-		block, err = h.createBlock(h.lastMove, curMove, next, useSTrap)
-
-		//TODO: better resize logic
-		switch err {
-		case nil:
-			h.tail.Write(block)
-			goto success
-		//TODO: figure out which of these is better....
-		/*case physics.ErrEaseLimitPre:
-			curMove = curMove.Scale(resizeScale)
-		case physics.ErrEaseLimitPost:
-			next = next.Scale(resizeScale)*/
-		case physics.ErrEaseLimitPre, physics.ErrEaseLimitPost:
-			curMove = curMove.Scale(resizeScale)
-		default:
-			panic(err)
+	if m.jerk > 0 {
+		block, err := physics.STrapBlock(m.jerk, m.acc, m.acc, m.frStart, move, frEnd)
+		if err == nil {
+			res.MotionBlock = block
+			return res, nil
 		}
+		h.head.Write(failedSCurve)
+		res.SCurveFallback = true
 	}
-	h.head.Write(fmt.Sprintf("debug:failed block: %v", block.GetShape()))
-	return curMove, false
 
-success:
-	h.curMove = curMove
-	h.pushMove(next)
-	return curMove, true
+	block, err := physics.TrapBlock(m.acc, m.frStart, move, frEnd)
+	if err != nil {
+		// the planned start and end fr can always be joined with constant acceleration
+		block, err = physics.PulseBlock(m.frStart, move, frEnd)
+	}
+	if err != nil {
+		h.head.Write(fmt.Sprintf("debug:failed block: %v", err))
+		return res, newError("physics", KindEase, "failed to ease FR for block. Start: %v, Move: %v, End: %v",
+			m.frStart, &move, frEnd)
+	}
+	res.MotionBlock = block
+	return res, nil
 }
 
-func (h *physicsHandler) pushMove(next physics.Move) {
-	h.lastMove = h.curMove
-	h.curMove = next
+// sendMove sends the first buffered move as a motion block.
+func (h *physicsHandler) sendMove() *Error {
+	m := h.moves[0]
+	h.moves = h.moves[1:]
+
+	frEnd := 0.0
+	if len(h.moves) > 0 {
+		frEnd = h.moves[0].frStart
+	}
+	block, err := h.createBlock(m, frEnd)
+	if err != nil {
+		h.moves = nil
+		return err
+	}
+	h.tail.Write(block)
+	return nil
 }
 
-/* TODO: we need to look at the number of ticks a move will make, and figure out what shape to use!!
-low number of steps can be pulses.
-Could overlap of 'invalid' start/end dt be used as a factor?
-*/
-func (h *physicsHandler) procMove(next physics.Move) {
-	next = h.limitResize(next)
+// procMove adds the next move to the lookahead buffer, and sends
+// the moves that fall out of it.
+func (h *physicsHandler) procMove(next physics.Move) *Error {
+	fr := next.Fr()
+	next, err := h.limitResize(next)
+	if err != nil || !next.NonEmpty() {
+		return err
+	}
 
-	var ok bool
-	if _, ok = h.procMoveSafe(next, maxSCurveResize, true); ok {
-		return
+	var pre physics.Move
+	if len(h.moves) > 0 {
+		pre = h.moves[len(h.moves)-1].Move
 	}
-	h.head.Write(failedSCurve)
-	if next, ok = h.procMoveSafe(next, maxNormResize, false); ok {
-		return
+	m := h.planMove(pre, next)
+	m.resized = next.Fr() < fr
+	h.moves = append(h.moves, m)
+	h.replan()
+
+	for len(h.moves) > h.lookahead {
+		if err := h.sendMove(); err != nil {
+			return err
+		}
 	}
-	panic(fmt.Sprintf("failed to ease FR for block. Pre: %v, Move: %v, Post: %v", &h.lastMove, &h.curMove, &next))
+	return nil
 }
-func (h *physicsHandler) endBlock() {
-	h.procMove(physics.Move{})
-	h.procMove(physics.Move{})
-	h.procMove(physics.Move{})
+
+/*
+procPathMove brings the buffered moves to a stop before and after each
+non-print move, unless the move continues the same path (see PathMove).
+*/
+func (h *physicsHandler) procPathMove(m physics.Move, continues bool) *Error {
+	joined := h.continued
+	h.continued = continues
+	if m.IsPrintMove() {
+		return h.procMove(m)
+	}
+	if !joined {
+		if err := h.endBlock(); err != nil {
+			return err
+		}
+	}
+	if err := h.procMove(m); err != nil || continues {
+		return err
+	}
+	return h.endBlock()
+}
+
+// endBlock brings the buffered moves to a stop, and sends them.
+func (h *physicsHandler) endBlock() *Error {
+	for len(h.moves) > 0 {
+		if err := h.sendMove(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (h *physicsHandler) procConfig(conf config.Config) {
 	format := config.GetPageFormat(conf.Format)
 	h.sps = float64(conf.TicksPerSecond * format.SegmentSteps)
+	h.segRate = float64(conf.TicksPerSecond) / float64(format.SegmentSteps)
 	h.sJerk = conf.SJerk
+
+	h.lookahead = conf.Lookahead
+	if h.lookahead < 1 {
+		h.lookahead = defaultLookahead
+	}
+
+	switch conf.Cornering {
+	case "", config.CorneringDot, config.CorneringJunctionDeviation:
+		h.cornering = conf.Cornering
+	default:
+		h.sup.Fail(newError("physics", KindConfig, "unknown cornering model %v", conf.Cornering))
+	}
+	h.junctionDev = conf.JunctionDeviation
+	if h.cornering == config.CorneringJunctionDeviation && !(h.junctionDev > 0) {
+		h.sup.Fail(newError("physics", KindConfig, "junction deviation must be positive, got %v", h.junctionDev))
+	}
+
+	kin, err := newKinematics(conf)
+	if err != nil {
+		h.sup.Fail(newError("physics", KindConfig, "%v", err))
+		return
+	}
+	h.kin = kin
 }
 
-func (h *physicsHandler) limitResize(m physics.Move) physics.Move {
+// limitResize slows the move down to the highest fr that keeps each
+// motor within its max velocity, and the max step rate. Moves that end
+// out of reach of the motors are rejected.
+func (h *physicsHandler) limitResize(m physics.Move) (physics.Move, *Error) {
 	if !m.NonEmpty() {
-		return m
+		return m, nil
 	}
-	for i := 0; i < maxLimitResize; i++ {
-		if m.Vel().Within(h.maxSV) && m.Vel().Within(h.maxV) {
-			return m
-		}
-		m = m.Scale(resizeScale)
-		//h.head.Write("debug:resizing move to " + m.String())
+	if !physics.InReach(h.kin, m.To()) {
+		return m, newError("physics", KindMoveLimit, "move (%v) is out of reach", &m)
+	}
+	fr := math.Min(
+		physics.MotorLimit(h.kin, m.From(), m.To(), h.maxV),
+		physics.MotorLimit(h.kin, m.From(), m.To(), h.maxSV))
+	switch {
+	case !(fr > 0):
+		return m, newError("physics", KindMoveLimit, "move (%v) cannot fit within max velocity (%v, %v)",
+			&m, h.maxSV, h.maxV)
+	case fr < m.Fr():
+		m = physics.NewMove(m.From(), m.To(), fr)
 	}
-	panic(fmt.Sprintf("move (%v) cannot fit within max velocity (%v, %v)", m, h.maxSV, h.maxV))
+	return m, nil
 }
 
-func PhysicsHandler(head, tail io.Conn) {
+func PhysicsHandler(sup *Supervisor, head, tail io.Conn) {
 	h := physicsHandler{
-		head: head, tail: tail,
+		head: head, tail: tail, sup: sup,
+
+		lookahead: defaultLookahead,
+		kin:       physics.Cartesian,
 	}
 
-	go func() {
-		for msg := range tail.Rc() {
+	sup.Go(func() {
+		for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
 			head.Write(msg)
 		}
-	}()
+		head.Close()
+	})
 
-	for msg := range head.Rc() {
+	for msg, ok := head.Read(); ok; msg, ok = head.Read() {
 		h.headRead(msg)
 	}
+	if err := h.endBlock(); err != nil {
+		sup.Fail(err)
+	}
+	tail.Close()
 }
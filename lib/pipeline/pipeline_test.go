@@ -1,8 +1,12 @@
 package pipeline
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,6 +15,9 @@ import (
 	"github.com/colinrgodsey/step-daemon/lib/config"
 	"github.com/colinrgodsey/step-daemon/lib/gcode"
 	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/physics"
+	"github.com/colinrgodsey/step-daemon/lib/sim"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
 )
 
 func TestConfigHandler(t *testing.T) {
@@ -28,13 +35,15 @@ func TestConfigHandler(t *testing.T) {
 	conf := config.Config{BedMax: f64.Vec2{100, 100}, BedSamplesPath: "test-samples.json"}
 	defer os.Remove(conf.BedSamplesPath)
 
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
 	head := io.NewConn(32, 32)
 	tail := io.NewConn(32, 32)
-	go ConfigHandler("../../config.hjson")(head.Flip(), tail.Flip())
+	go ConfigHandler("../../config.hjson")(sup, head.Flip(), tail.Flip())
 
 	go func() {
 		head.Write(conf)
-		head.Write(confEnd)
 		head.Write(gcode.New('G', 29))
 
 		tail.Write(blStart)
@@ -72,3 +81,1031 @@ collect:
 		//fmt.Println(z)
 	}
 }
+
+func testSimPipeline(sup *Supervisor) (*sim.Device, io.Conn) {
+	d := sim.NewDevice("SP_4x2_256", sim.DefaultSettings, false)
+
+	head := io.NewConn(32, 32)
+	c := sup.Start(head, 8, SourceHandler)
+	c = sup.Start(c, 1, ConfigHandler("../../config.hjson"))
+	c = sup.Start(c, 1, DeltaHandler)
+	c = sup.Start(c, 1, PhysicsHandler)
+	c = sup.Start(c, NumPages, StepHandler)
+	c = sup.Start(c, MaxPendingCommands, DeviceHandler)
+	go io.LinePipe(d, d, c)
+
+	return d, head.WithContext(sup.Context())
+}
+
+func TestSimPipeline(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+	d, head := testSimPipeline(sup)
+	defer d.Close()
+
+	go func() {
+		head.Write("G28")
+		head.Write("G90")
+		head.Write("G1 X10 Y5 Z1 F3000")
+		head.Write("G1 X20 Y15 E2 F1800")
+		head.Write("G1 X0 Y0 Z0 E1 F6000")
+		head.Write("G1 X20 Y15 Z1 F3000")
+		head.Write("M114") // flushes the last page
+	}()
+
+	// Z is left out, bed leveling may be active
+	target := vec.NewVec4(20, 15, 0, 1)
+	spmm := sim.DefaultSettings.StepsPerMM
+	timer := time.After(30 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatalf("timed out, device at %v", d.Position())
+		case <-head.Rc():
+		case <-time.After(10 * time.Millisecond):
+		}
+		x, y, _, e := d.Position().Get()
+		if vec.NewVec4(x, y, 0, e).Sub(target).Abs().Within(spmm.Inv()) {
+			return
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	var est Estimate
+	head := io.NewConn(32, 32)
+	c := sup.Start(head, 8, SourceHandler)
+	c = sup.Start(c, 1, ConfigHandler("../../config.hjson"))
+	c = sup.Start(c, 1, DeltaHandler)
+	c = sup.Start(c, 1, PhysicsHandler)
+	sup.Start(c, 1, EstimateHandler(sim.DefaultSettings.Report(), &est))
+
+	go func() {
+		head.Write("G28")
+		head.Write("G90")
+		head.Write("G1 X10 Y10 Z0.2 F30000") // faster than the max feedrate
+		for i, z := range []string{"0.2", "0.4"} {
+			head.Write("G1 Z" + z + " F300")
+			head.Write(fmt.Sprintf("G1 X20 E%v F1800", i*4+1))
+			head.Write(fmt.Sprintf("G1 Y20 E%v", i*4+2))
+			head.Write(fmt.Sprintf("G1 X10 E%v", i*4+3))
+			head.Write(fmt.Sprintf("G1 Y10 E%v", i*4+4))
+		}
+		head.Close()
+	}()
+
+	timer := time.After(30 * time.Second)
+	for done := false; !done; {
+		select {
+		case <-timer:
+			t.Fatal("timed out")
+		case msg := <-head.Rc():
+			done = io.IsClosed(msg)
+		}
+	}
+	if err := sup.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// 80mm of printing at 30mm/s
+	if est.Time < 80.0/30 || est.Time > 80.0/30+3 {
+		t.Fatalf("Unexpected print time %v", est.Time)
+	}
+	if est.Filament != 8 {
+		t.Fatalf("Expected 8mm of filament, got %v", est.Filament)
+	}
+	if est.Resized != 1 {
+		t.Fatalf("Expected 1 resized move, got %v", est.Resized)
+	}
+	if len(est.Layers) != 2 || est.Layers[0].Z != 0.2 || est.Layers[1].Z != 0.4 {
+		t.Fatalf("Unexpected layers %v", est.Layers)
+	}
+	if d := est.Layers[0].Time + est.Layers[1].Time - est.Time; math.Abs(d) > 1e-9 {
+		t.Fatalf("Layer times are off by %v", d)
+	}
+}
+
+func TestInputShaper(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+	d, head := testSimPipeline(sup)
+	defer d.Close()
+
+	go func() {
+		head.Write("G28")
+		head.Write("G90")
+		head.Write("M593 X Y TZVD F40 D0.1")
+		head.Write("M900 K0.05")
+		head.Write("G1 X10 Y5 E1 F6000")
+		head.Write("G1 X20 Y15 E2 F6000")
+		head.Write("M114") // drains the filters
+	}()
+
+	// shaped and advanced motion must come to rest at the target
+	target := vec.NewVec4(20, 15, 0, 2)
+	spmm := sim.DefaultSettings.StepsPerMM
+	shaped := false
+	timer := time.After(30 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatalf("timed out, device at %v", d.Position())
+		case msg := <-head.Rc():
+			if str, ok := msg.(string); ok && strings.Index(str, "info:input shaper for Y is ZVD") == 0 {
+				shaped = true
+			}
+		case <-time.After(10 * time.Millisecond):
+		}
+		x, y, _, e := d.Position().Get()
+		if shaped && vec.NewVec4(x, y, 0, e).Sub(target).Abs().Within(spmm.Inv()) {
+			return
+		}
+	}
+}
+
+func TestSourceRestart(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	head := io.NewConn(8, 8)
+	tail := sup.Start(head, 8, SourceHandler).Flip()
+
+	tail.Write("pages_ready")
+	tail.Write("start")
+	tail.Write("pages_ready")
+
+	timer := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatal("timed out")
+		case msg := <-head.Rc():
+			if _, ok := msg.(DeviceRestart); ok {
+				return
+			}
+		}
+	}
+}
+
+func TestSourceUnexpected(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	head := io.NewConn(8, 8)
+	tail := sup.Start(head, 8, SourceHandler).Flip()
+
+	tail.Write("pages_ready")
+	tail.Write(42)
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	case <-sup.Fault():
+		if err := sup.Err(); err.Kind != KindProtocol {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+	d, head := testSimPipeline(sup)
+	defer d.Close()
+
+	go func() {
+		head.Write("G28")
+		head.Write("G90")
+		head.Write("M203 X0")
+		head.Write("G1 X10 F3000") // can never fit within max velocity
+		head.Write("G1 X20 F3000")
+	}()
+
+	timer := time.After(30 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatal("timed out")
+		case msg := <-head.Rc():
+			if str, ok := msg.(string); ok && strings.Index(str, "Error:") == 0 {
+				if !strings.Contains(str, string(KindMoveLimit)) {
+					t.Fatalf("Unexpected error %v", str)
+				}
+				<-sup.Done()
+				if x := d.Position().X(); x != 0 {
+					t.Fatalf("Device moved after fault (%v)", x)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	d, head := testSimPipeline(sup)
+	defer d.Close()
+
+	go func() {
+		head.Write("G28")
+		head.Write("G90")
+		head.Write("G1 X10 Y5 E1 F3000")
+		head.Write("G1 X20 Y15 E2 F1800")
+		head.Close()
+	}()
+
+	timer := time.After(30 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatalf("timed out, device at %v", d.Position())
+		case msg := <-head.Rc():
+			if !io.IsClosed(msg) {
+				continue
+			}
+		}
+		break
+	}
+
+	// all pages must have run without any trailing gcode to flush them
+	x, y, _, e := d.Position().Get()
+	if !vec.NewVec4(x, y, 0, e).Sub(vec.NewVec4(20, 15, 0, 2)).Abs().Within(sim.DefaultSettings.StepsPerMM.Inv()) {
+		t.Fatalf("Pipeline did not drain, device at %v", d.Position())
+	}
+
+	// all handlers exit without cancellation
+	sup.Wait()
+}
+
+// testPhysics runs msgs through a PhysicsHandler, and returns the motion
+// blocks produced. Fails on any error or warning.
+func testPhysics(t *testing.T, conf config.Config, msgs ...io.Any) []physics.MotionBlock {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	head := io.NewConn(32, 32)
+	tail := sup.Start(head, 32, PhysicsHandler).Flip()
+
+	go func() {
+		head.Write(conf)
+		head.Write(gcode.New('M', 92, "X80", "Y80", "Z1600", "E400"))
+		head.Write(gcode.New('M', 201, "X1000", "Y1000", "Z100", "E1000"))
+		head.Write(gcode.New('M', 203, "X300", "Y300", "Z7", "E50"))
+		for _, msg := range msgs {
+			head.Write(msg)
+		}
+		head.Close()
+	}()
+
+	warnings := make(chan string, 1)
+	go func() {
+		for msg, ok := head.Read(); ok; msg, ok = head.Read() {
+			if str, ok := msg.(string); ok && strings.Index(str, "warn:") == 0 {
+				select {
+				case warnings <- str:
+				default:
+				}
+			}
+		}
+	}()
+
+	var blocks []physics.MotionBlock
+	for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
+		if block, ok := msg.(physics.MotionBlock); ok {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sup.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case str := <-warnings:
+		t.Fatalf("Unexpected warning: %v", str)
+	default:
+	}
+	return blocks
+}
+
+var testPhysicsConfig = config.Config{
+	SJerk:          vec.NewVec4(1e5, 1e5, 1e6, 1e8),
+	TicksPerSecond: 61440,
+	Format:         "SP_4x2_256",
+	Lookahead:      16,
+}
+
+func TestLookahead(t *testing.T) {
+	const (
+		fr    = 100.0
+		steps = 180
+	)
+
+	// dense half circle, 1 degree per segment
+	var moves []io.Any
+	from := vec.NewVec4(50, 0, 0, 0)
+	for i := 1; i <= steps; i++ {
+		a := float64(i) * math.Pi / steps
+		to := vec.NewVec4(50*math.Cos(a), 50*math.Sin(a), 0, float64(i)*0.05)
+		moves = append(moves, physics.NewMove(from, to, fr))
+		from = to
+	}
+
+	blocks := testPhysics(t, testPhysicsConfig, moves...)
+	if len(blocks) != steps {
+		t.Fatalf("Expected %v blocks, got %v", steps, len(blocks))
+	}
+
+	lastEnd := 0.0
+	for i, block := range blocks {
+		shape := block.GetShape()
+		start, end := shape.Apply(0), shape.Apply(shape.Dt())
+		if math.Abs(start-lastEnd) > 1e-6 {
+			t.Fatalf("Block %v starts at %v, previous ended at %v", i, start, lastEnd)
+		}
+		if i > steps/4 && i < steps*3/4 && start < fr*0.95 {
+			t.Fatalf("Block %v slowed down to %v", i, start)
+		}
+		lastEnd = end
+	}
+	if lastEnd > 1e-6 {
+		t.Fatalf("Last block did not stop (%v)", lastEnd)
+	}
+}
+
+func TestTinyMoves(t *testing.T) {
+	const (
+		fr    = 100.0
+		steps = 2000
+	)
+
+	// high resolution circle, a few steps per segment
+	var moves []io.Any
+	from := vec.NewVec4(10, 0, 0, 0)
+	for i := 1; i <= steps; i++ {
+		a := float64(i) * 2 * math.Pi / steps
+		to := vec.NewVec4(10*math.Cos(a), 10*math.Sin(a), 0, float64(i)*0.001)
+		moves = append(moves, physics.NewMove(from, to, fr))
+		from = to
+	}
+
+	blocks := testPhysics(t, testPhysicsConfig, moves...)
+	if len(blocks) != steps {
+		t.Fatalf("Expected %v blocks, got %v", steps, len(blocks))
+	}
+
+	lastEnd := 0.0
+	for i, block := range blocks {
+		shape := block.GetShape()
+		start, end := shape.Apply(0), shape.Apply(shape.Dt())
+		if math.Abs(start-lastEnd) > 1e-6 {
+			t.Fatalf("Block %v starts at %v, previous ended at %v", i, start, lastEnd)
+		}
+		if !shape.IsValid() {
+			t.Fatalf("Block %v is invalid: %v", i, shape)
+		}
+		if shape.Der1At(0) != shape.Der1At(shape.Dt()/2) {
+			t.Fatalf("Block %v should be a single pulse: %v", i, shape)
+		}
+		lastEnd = end
+	}
+	if lastEnd > 1e-6 {
+		t.Fatalf("Last block did not stop (%v)", lastEnd)
+	}
+}
+
+func TestRandomGeometry(t *testing.T) {
+	const steps = 2000
+	rnd := rand.New(rand.NewSource(1))
+
+	// random lengths from 0.1um to 100mm, in random directions
+	var moves []io.Any
+	from := vec.NewVec4(100, 100, 10, 0)
+	for i := 0; i < steps; i++ {
+		dist := math.Pow(10, rnd.Float64()*6-4)
+		a := rnd.Float64() * 2 * math.Pi
+		dir := vec.NewVec4(math.Cos(a), math.Sin(a), rnd.Float64()*0.01, rnd.Float64()*0.05)
+		to := from.Add(dir.Mul(dist))
+		moves = append(moves, physics.NewMove(from, to, 1+rnd.Float64()*299))
+		from = to
+	}
+
+	for _, cornering := range []string{config.CorneringDot, config.CorneringJunctionDeviation} {
+		conf := testPhysicsConfig
+		conf.Cornering = cornering
+		conf.JunctionDeviation = 0.05
+
+		blocks := testPhysics(t, conf, moves...)
+		if len(blocks) != steps {
+			t.Fatalf("Expected %v blocks, got %v", steps, len(blocks))
+		}
+	}
+}
+
+func TestJunctionDeviation(t *testing.T) {
+	// 90* corner of a path, with the deviation reported by the device. X and Y
+	// at 707.107 mm/s^2 give 1000 mm/s^2 along the diagonal of the junction.
+	msgs := []io.Any{
+		gcode.New('M', 201, "X707.107", "Y707.107"),
+		gcode.New('M', 205, "J0.05"),
+		PathMove{physics.NewMove(vec.NewVec4(0, 0, 0, 0), vec.NewVec4(20, 0, 0, 0), 100)},
+		physics.NewMove(vec.NewVec4(20, 0, 0, 0), vec.NewVec4(20, 20, 0, 0), 100),
+	}
+
+	for _, c := range []struct {
+		cornering string
+		expected  float64
+	}{
+		// sin(45*) = 0.70711, sqrt(1000 * 0.05 * 0.70711 / (1 - 0.70711))
+		{config.CorneringJunctionDeviation, 10.98686},
+		// M205 J is ignored, and dot corners stop at 90*
+		{config.CorneringDot, 0},
+	} {
+		conf := testPhysicsConfig
+		conf.Cornering = c.cornering
+		conf.JunctionDeviation = 1
+
+		blocks := testPhysics(t, conf, msgs...)
+		if len(blocks) != 2 {
+			t.Fatalf("Expected 2 blocks, got %v", len(blocks))
+		}
+		if fr := blocks[1].GetShape().Apply(0); math.Abs(fr-c.expected) > 1e-3 {
+			t.Fatalf("Expected %v junction fr of %v, got %v", c.cornering, c.expected, fr)
+		}
+	}
+}
+
+func TestJunctionDeviationLimits(t *testing.T) {
+	run := func(dev float64, msgs ...io.Any) ([]string, *Error) {
+		sup := NewSupervisor(context.Background())
+		defer sup.Stop()
+
+		head := io.NewConn(32, 32)
+		tail := sup.Start(head, 32, PhysicsHandler).Flip()
+
+		conf := testPhysicsConfig
+		conf.Cornering = config.CorneringJunctionDeviation
+		conf.JunctionDeviation = dev
+		go func() {
+			head.Write(conf)
+			for _, msg := range msgs {
+				head.Write(msg)
+			}
+			head.Close()
+		}()
+
+		var lines []string
+		done := make(chan struct{})
+		go func() {
+			for msg, ok := head.Read(); ok; msg, ok = head.Read() {
+				if str, ok := msg.(string); ok {
+					lines = append(lines, str)
+				}
+			}
+			close(done)
+		}()
+		for _, ok := tail.Read(); ok; _, ok = tail.Read() {
+		}
+		tail.Close()
+		<-done
+		return lines, sup.Err()
+	}
+
+	for _, dev := range []float64{0, -0.05} {
+		if _, err := run(dev); err == nil || err.Kind != KindConfig {
+			t.Fatalf("Expected a config error for junction deviation %v, got %v", dev, err)
+		}
+	}
+
+	lines, err := run(0.05, gcode.New('M', 205, "J-1"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if warns := linesWith(lines, "warn:"); len(warns) != 1 || !strings.Contains(warns[0], "junction deviation") {
+		t.Fatalf("Expected a warning for M205 J-1, got %v", lines)
+	}
+}
+
+func TestAxisLimits(t *testing.T) {
+	blocks := testPhysics(t, testPhysicsConfig,
+		gcode.New('M', 201, "Y500"),
+		gcode.New('M', 203, "Y100"),
+		physics.NewMove(vec.NewVec4(0, 0, 0, 0), vec.NewVec4(30, 40, 0, 0), 1000),
+	)
+	if len(blocks) != 1 {
+		t.Fatalf("Expected 1 block, got %v", len(blocks))
+	}
+
+	// Y is the limiting axis for both
+	move := blocks[0].GetMove()
+	if vy := move.Vel().Y(); math.Abs(vy-100) > 1e-6 {
+		t.Fatalf("Expected Y velocity of 100, got %v", vy)
+	}
+
+	shape := blocks[0].GetShape()
+	maxAcc, dt := 0.0, 1e-4
+	for t := dt; t < shape.Dt(); t += dt {
+		acc := (shape.Apply(t) - shape.Apply(t-dt)) / dt
+		maxAcc = math.Max(maxAcc, math.Abs(acc))
+	}
+	if ay := maxAcc * 0.8; ay > 500*1.01 || ay < 500*0.9 {
+		t.Fatalf("Expected Y acceleration of 500, got %v", ay)
+	}
+}
+
+func TestMotorLimits(t *testing.T) {
+	conf := testPhysicsConfig
+	conf.Kinematics = physics.KinematicsCoreXY
+
+	blocks := testPhysics(t, conf,
+		gcode.New('M', 201, "X500", "Y500"),
+		gcode.New('M', 203, "X100", "Y100"),
+		physics.NewMove(vec.NewVec4(0, 0, 0, 0), vec.NewVec4(30, 30, 0, 0), 1000),
+	)
+	if len(blocks) != 1 {
+		t.Fatalf("Expected 1 block, got %v", len(blocks))
+	}
+
+	// only the A motor moves, at twice the rate of each axis
+	move := blocks[0].GetMove()
+	if vx := move.Vel().X(); math.Abs(vx-50) > 1e-6 {
+		t.Fatalf("Expected X velocity of 50, got %v", vx)
+	}
+
+	shape := blocks[0].GetShape()
+	maxAcc := 0.0
+	for t := 0.0; t < shape.Dt(); t += 1e-4 {
+		maxAcc = math.Max(maxAcc, math.Abs(shape.Der1At(t)))
+	}
+	if ax := maxAcc / math.Sqrt2; math.Abs(ax-250) > 1 {
+		t.Fatalf("Expected X acceleration of 250, got %v", ax)
+	}
+}
+
+func TestDeltaLimits(t *testing.T) {
+	conf := testPhysicsConfig
+	conf.Kinematics = physics.KinematicsDelta
+	conf.Delta = config.Delta{Radius: 100, DiagonalRod: 200}
+	conf.SJerk = vec.NewVec4(1e7, 1e7, 1e7, 1e8) // each carriage drives XYZ
+
+	edge := physics.NewMove(vec.NewVec4(0, -90, 0, 0), vec.NewVec4(0, -95, 0, 0), 1000)
+	blocks := testPhysics(t, conf,
+		gcode.New('M', 92, "Z80"),
+		gcode.New('M', 201, "Z1e5"),
+		gcode.New('M', 203, "X300", "Y300", "Z300"),
+		physics.NewMove(vec.NewVec4(-10, 0, 0, 0), vec.NewVec4(10, 0, 0, 0), 1000),
+		edge,
+	)
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %v", len(blocks))
+	}
+
+	// the C arm is close to horizontal at the edge
+	kin, _ := newKinematics(conf)
+	limit := physics.MotorLimit(kin, edge.From(), edge.To(), vec.NewVec4(300, 300, 300, 50))
+	if fr := blocks[1].GetMove(); math.Abs(fr.Fr()-limit) > 1e-6 {
+		t.Fatalf("Expected fr of %v at the edge, got %v", limit, fr.Fr())
+	}
+	if fr := blocks[0].GetMove(); fr.Fr() < 2*limit {
+		t.Fatalf("Expected a higher fr at the center, got %v", fr.Fr())
+	}
+}
+
+// testDeltaHandler runs the G-code lines through a DeltaHandler, and returns
+// the moves and the lines sent upstream. M114 is answered with devicePos.
+// Fails if an arc or spline is forwarded.
+func testDeltaHandler(t *testing.T, conf config.Config, lines ...string) ([]physics.Move, []string) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	head := io.NewConn(32, 32)
+	tail := sup.Start(head, 32, DeltaHandler).Flip()
+
+	go func() {
+		head.Write(conf)
+		for _, line := range lines {
+			g, _ := gcode.Parse(line)
+			head.Write(g)
+		}
+		head.Close()
+	}()
+
+	var upstream []string
+	done := make(chan struct{})
+	go func() {
+		for msg, ok := head.Read(); ok; msg, ok = head.Read() {
+			if str, ok := msg.(string); ok {
+				upstream = append(upstream, str)
+			}
+		}
+		close(done)
+	}()
+
+	var moves []physics.Move
+	var sent []gcode.GCode
+	for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
+		switch msg := msg.(type) {
+		case physics.Move:
+			moves = append(moves, msg)
+		case PathMove:
+			moves = append(moves, msg.Move)
+		case gcode.GCode:
+			sent = append(sent, msg)
+			if msg.IsM(114) {
+				tail.Write(devicePos)
+			}
+		}
+	}
+	tail.Close()
+	<-done
+
+	for _, g := range sent {
+		if g.IsG(2) || g.IsG(3) || g.IsG(5) || g.IsG(10) || g.IsG(11) {
+			t.Fatalf("Planned command sent to the device: %v", g)
+		}
+	}
+	return moves, upstream
+}
+
+const devicePos = "X:25.40 Y:50.80 Z:0.00 E:0.00 Count X:2032 Y:4064 Z:0"
+
+// linesWith returns the lines that start with prefix.
+func linesWith(lines []string, prefix string) (res []string) {
+	for _, line := range lines {
+		if strings.Index(line, prefix) == 0 {
+			res = append(res, line)
+		}
+	}
+	return
+}
+
+// checkMoves checks that the moves are joined, from start to end.
+func checkMoves(t *testing.T, moves []physics.Move, start, end vec.Vec4) {
+	pos := start
+	for i, m := range moves {
+		if !m.From().Eq(pos) {
+			t.Fatalf("Move %v does not start at the end of the last: %v", i, m.String())
+		}
+		pos = m.To()
+	}
+	if !pos.Sub(end).Abs().Within(vec.NewVec4(1e-9, 1e-9, 1e-9, 1e-9)) {
+		t.Fatalf("Expected moves to end at %v, got %v", end, pos)
+	}
+}
+
+// testCurves runs the G-code lines through a DeltaHandler, then plans the
+// moves with testPhysics.
+func testCurves(t *testing.T, lines ...string) []physics.MotionBlock {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	head := io.NewConn(32, 32)
+	tail := sup.Start(head, 32, DeltaHandler).Flip()
+
+	go func() {
+		head.Write(testPhysicsConfig)
+		head.Write(gcode.New('M', 201, "X1000", "Y1000", "Z100", "E1000"))
+		for _, line := range lines {
+			g, _ := gcode.Parse(line)
+			head.Write(g)
+		}
+		head.Close()
+	}()
+	go func() {
+		for _, ok := head.Read(); ok; _, ok = head.Read() {
+		}
+	}()
+
+	var msgs []io.Any
+	for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
+		switch msg.(type) {
+		case physics.Move, PathMove:
+			msgs = append(msgs, msg)
+		}
+	}
+	tail.Close()
+	return testPhysics(t, testPhysicsConfig, msgs...)
+}
+
+// checkCurve checks that a planned curve, after a travel move to its
+// start, keeps close to fr through its inner chords.
+func checkCurve(t *testing.T, blocks []physics.MotionBlock, fr float64) {
+	if len(blocks) < 10 {
+		t.Fatalf("Expected the curve to be split into chords, got %v blocks", len(blocks))
+	}
+	for i, block := range blocks[1:] {
+		start := block.GetShape().Apply(0)
+		if i == 0 && start > 1e-6 {
+			t.Fatalf("Curve should start from a stop, started at %v", start)
+		}
+		if i > len(blocks)/4 && i < len(blocks)*3/4 && start < fr*0.95 {
+			t.Fatalf("Chord %v slowed down to %v", i, start)
+		}
+	}
+}
+
+func TestArcs(t *testing.T) {
+	moves, lines := testDeltaHandler(t, config.Config{ArcTolerance: 0.05},
+		"G90",
+		"G0 X10 F6000",
+		"G2 X0 Y10 I-10 J0 E1 F600", // 3/4 circle
+		"G3 X0 Y10 R2",              // no radius for a full circle
+		"G18",
+		"G91",
+		"G3 X0 Z-10 R5 Y1", // half circle helix in ZX
+	)
+	if errs := linesWith(lines, "error:"); len(errs) != 1 {
+		t.Fatalf("Expected 1 invalid arc, got %v", errs)
+	}
+	moves = moves[1:]
+	checkMoves(t, moves, vec.NewVec4(10, 0, 0, 0), vec.NewVec4(0, 11, -10, 1))
+
+	// the XY arc goes the long way round, clockwise
+	for _, m := range moves {
+		if to := m.To(); to.E() < 1 && (to.X() > 0 && to.Y() > 0) {
+			t.Fatalf("Clockwise arc passed through %v", to)
+		}
+		if d := math.Hypot(m.To().X(), m.To().Y()); m.To().E() < 1 && math.Abs(d-10) > 1e-9 {
+			t.Fatalf("Arc point %v is off the circle", m.To())
+		}
+	}
+}
+
+func TestArcJunctions(t *testing.T) {
+	// travel half circle without E
+	checkCurve(t, testCurves(t,
+		"G90",
+		"G0 X50 F6000",
+		"G2 X-50 Y0 I-50 J0",
+	), 100)
+}
+
+func TestSplines(t *testing.T) {
+	// quarter circles of radius 10, limited to sqrt(100 * 10) mm/s
+	const k = 10 * 0.5523
+	moves, lines := testDeltaHandler(t, config.Config{ArcTolerance: 0.01},
+		"G90",
+		"G0 X10 F6000",
+		"M201 X100 Y200",
+		"G5 X0 Y10 P0 Q-"+fmt.Sprint(k)+" E1 F6000", // no I and J
+		"G5 X0 Y10 I0 J"+fmt.Sprint(k)+" P"+fmt.Sprint(k)+" Q0 E1",
+		"G5 X-10 Y0 P0 Q"+fmt.Sprint(k)+" E2", // mirrors the last control point
+	)
+	if errs := linesWith(lines, "error:"); len(errs) != 1 {
+		t.Fatalf("Expected 1 invalid spline, got %v", errs)
+	}
+	moves = moves[1:]
+	checkMoves(t, moves, vec.NewVec4(10, 0, 0, 0), vec.NewVec4(-10, 0, 0, 2))
+
+	for _, m := range moves {
+		if d := math.Hypot(m.To().X(), m.To().Y()); math.Abs(d-10) > 0.01 {
+			t.Fatalf("Spline point %v is off the circle", m.To())
+		}
+		if fr := m.Fr(); fr > math.Sqrt(1000)*1.01 || fr < math.Sqrt(1000)*0.99 {
+			t.Fatalf("Expected fr to be limited by curvature, got %v", fr)
+		}
+	}
+
+	// travel spline without E, about a half circle
+	checkCurve(t, testCurves(t,
+		"G90",
+		"G0 X50 F6000",
+		"G5 X-50 Y0 I0 J66 P0 Q66",
+	), 100)
+}
+
+func TestExtrusionModes(t *testing.T) {
+	moves, _ := testDeltaHandler(t, config.Config{},
+		"G90",
+		"M83",
+		"G1 X10 E1 F600", // relative E
+		"G1 X20 E1",
+		"G92 E0",
+		"G1 E1",
+		"M82", // absolute E
+		"G1 X10 E3",
+		"G91", // relative E again
+		"G1 X1 E1",
+		"M82",
+		"G1 X1 E5", // relative XYZ, absolute E
+		"G90",
+		"G1 X0 E6",
+	)
+	var es, xs []float64
+	for _, m := range moves {
+		xs = append(xs, m.To().X())
+		es = append(es, m.To().E())
+	}
+	if exp := []float64{1, 2, 1, 3, 4, 5, 6}; fmt.Sprint(es) != fmt.Sprint(exp) {
+		t.Fatalf("Expected E positions %v, got %v", exp, es)
+	}
+	if exp := []float64{10, 20, 20, 10, 11, 12, 0}; fmt.Sprint(xs) != fmt.Sprint(exp) {
+		t.Fatalf("Expected X positions %v, got %v", exp, xs)
+	}
+}
+
+func TestInchUnits(t *testing.T) {
+	moves, lines := testDeltaHandler(t, config.Config{},
+		"G20",
+		"G90",
+		"G0 X1 F600",
+		"G1 X2 E0.1 F60",      // 1in/s
+		"G2 X2 Y0 I-1 J0 F60", // full circle, radius 1in
+		"M114",
+		"G21",
+		"G1 X10 F600",
+		"M114",
+	)
+
+	if m := moves[1]; !m.To().Sub(vec.NewVec4(50.8, 0, 0, 2.54)).Abs().Within(vec.NewVec4(1e-9, 1e-9, 1e-9, 1e-9)) || math.Abs(m.Fr()-25.4) > 1e-9 {
+		t.Fatalf("Expected move to 2in at 1in/s, got %v", m.String())
+	}
+	for _, m := range moves[2 : len(moves)-1] {
+		if d := math.Hypot(m.To().X()-25.4, m.To().Y()); math.Abs(d-25.4) > 1e-9 {
+			t.Fatalf("Arc point %v is off the circle", m.To())
+		}
+	}
+
+	// synced with the device (in mm), and reported in the active units
+	if m := moves[len(moves)-1]; !m.From().Eq(vec.NewVec4(25.4, 50.8, 0, 0)) || m.To().X() != 10 {
+		t.Fatalf("Expected move from the device position to 10mm, got %v", m.String())
+	}
+	exp := []string{
+		"X:1.0000 Y:2.0000 Z:0.0000 E:0.0000 Count X:2032 Y:4064 Z:0",
+		"X:25.40 Y:50.80 Z:0.00 E:0.00 Count X:2032 Y:4064 Z:0",
+	}
+	if pos := linesWith(lines, "X:"); fmt.Sprint(pos) != fmt.Sprint(exp) {
+		t.Fatalf("Expected positions %q, got %q", exp, pos)
+	}
+}
+
+func TestWorkCoordinates(t *testing.T) {
+	moves, lines := testDeltaHandler(t, config.Config{},
+		"G90",
+		"G0 X10 Y10 F600",
+		"G10 L2 P1 X5 Y5", // G54
+		"G0 X0 Y0",
+		"G55",
+		"G10 L20 P2 X1 Y1", // current position is 1, 1
+		"G0 X2 Y2",
+		"G92 X0 Y0",
+		"G0 X1 Y1",
+		"G53 G0 X0 Y0",
+		"G0 X1 Y1",
+		"G92.1",
+		"G0 X1 Y1",
+		"G59.3",
+		"G0 X1 Y1",
+		"G55",
+		"M114",
+		"G10 L3 P1 X0",
+		"G92 E5",
+		"G1 X1 Y1 E6",
+	)
+	if errs := linesWith(lines, "error:"); len(errs) != 1 {
+		t.Fatalf("Expected 1 invalid offset, got %v", errs)
+	}
+
+	var xs []float64
+	for _, m := range moves {
+		if m.To().X() != m.To().Y() {
+			t.Fatalf("Expected a diagonal move, got %v", m.String())
+		}
+		xs = append(xs, m.To().X())
+	}
+	if exp := []float64{10, 5, 6, 7, 0, 7, 5, 1, 5}; fmt.Sprint(xs) != fmt.Sprint(exp) {
+		t.Fatalf("Expected machine positions %v, got %v", exp, xs)
+	}
+	if m := moves[len(moves)-1]; m.From().E() != 5 || m.To().E() != 6 {
+		t.Fatalf("Expected E to move from 5 to 6, got %v", m.String())
+	}
+
+	exp := []string{"X:21.40 Y:46.80 Z:0.00 E:0.00 Count X:2032 Y:4064 Z:0"}
+	if pos := linesWith(lines, "X:"); fmt.Sprint(pos) != fmt.Sprint(exp) {
+		t.Fatalf("Expected work positions %q, got %q", exp, pos)
+	}
+}
+
+func TestRetraction(t *testing.T) {
+	moves, _ := testDeltaHandler(t, config.Config{},
+		"G90",
+		"G0 X10 Y10 F600",
+		"M207 S2 F1200 Z0.5",
+		"M208 S0.5 F600",
+		"G10",
+		"G10", // already retracted
+		"G0 X20 Y20",
+		"G11",
+		"G1 X30 Y30 E1",
+		"M209 S1",
+		"G1 E0", // auto retract
+		"G1 E1", // auto recover
+		"G1 X40 Y40 E2",
+	)
+	checkMoves(t, moves, vec.Vec4{}, vec.NewVec4(40, 40, 0, 3))
+
+	var ze []string
+	for _, m := range moves {
+		ze = append(ze, fmt.Sprintf("%v/%v", m.To().Z(), m.To().E()))
+	}
+	exp := []string{"0/0", "0/-2", "0.5/-2", "0.5/-2", "0/-2", "0/0.5", "0/1.5",
+		"0/-0.5", "0.5/-0.5", "0/-0.5", "0/2", "0/3"}
+	if fmt.Sprint(ze) != fmt.Sprint(exp) {
+		t.Fatalf("Expected Z/E positions %v, got %v", exp, ze)
+	}
+	if fr := moves[1].Fr(); fr != 20 {
+		t.Fatalf("Expected retract fr 20, got %v", fr)
+	}
+	if fr := moves[5].Fr(); fr != 10 {
+		t.Fatalf("Expected recover fr 10, got %v", fr)
+	}
+
+	// inches, with an auto retract
+	moves, _ = testDeltaHandler(t, config.Config{},
+		"G20",
+		"M207 S0.1 F60",
+		"M209 S1",
+		"G91",
+		"G1 E-0.1",
+	)
+	if len(moves) != 1 {
+		t.Fatalf("Expected a single retract, got %v moves", len(moves))
+	}
+	if m := moves[0]; math.Abs(m.Delta().E()+2.54) > 1e-9 || math.Abs(m.Fr()-25.4) > 1e-9 {
+		t.Fatalf("Expected a retract of 2.54mm at 25.4mm/s, got %v", m.String())
+	}
+}
+
+func TestSync(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+	d, head := testSimPipeline(sup)
+	defer d.Close()
+
+	go func() {
+		head.Write("G28")
+		head.Write("G90")
+		head.Write("G1 X10 F3000")
+		head.Write("M400")
+	}()
+
+	oks := 0
+	timer := time.After(30 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatalf("timed out, device at %v", d.Position())
+		case msg := <-head.Rc():
+			if msg != "ok" {
+				continue
+			}
+			if oks++; oks < 4 {
+				continue
+			}
+			if x := d.Position().X(); math.Abs(x-10) > 0.1 {
+				t.Fatalf("M400 acknowledged with the device at X%v", x)
+			}
+			return
+		}
+	}
+}
+
+func TestDwellPages(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	defer sup.Stop()
+
+	head := io.NewConn(32, 32)
+	tail := sup.Start(head, 32, StepHandler).Flip()
+
+	go func() {
+		head.Write(config.Config{TicksPerSecond: 30000, Format: "SP_4x2_256", DwellPages: true})
+		head.Write(gcode.New('G', 4, "P100"))
+		head.Close()
+	}()
+	go func() {
+		for _, ok := head.Read(); ok; _, ok = head.Read() {
+		}
+	}()
+
+	segments := 0
+	for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
+		switch msg := msg.(type) {
+		case PageData:
+			for _, b := range msg.Data {
+				if b != 0 {
+					t.Fatalf("Expected an idle page, got %v", msg.Data)
+				}
+			}
+			segments += len(msg.Data)
+		case gcode.GCode:
+			t.Fatalf("Dwell sent to the device: %v", msg)
+		}
+	}
+	tail.Close()
+
+	// 10000 segments per second
+	if segments != 1000 {
+		t.Fatalf("Expected 1000 idle segments, got %v", segments)
+	}
+}
@@ -2,26 +2,37 @@ package pipeline
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/colinrgodsey/step-daemon/lib/gcode"
 	"github.com/colinrgodsey/step-daemon/lib/io"
 )
 
-func SourceHandler(head, tail io.Conn) {
+// Initialized is sent upstream by SourceHandler once the device is ready,
+// and it starts reading G-code from the head.
+const Initialized = "info:stepd initialized"
+
+// IsAcked returns true if SourceHandler answers the line with an ok.
+// Blank and comment-only lines are dropped without one.
+func IsAcked(line string) bool {
+	return line != "" && strings.IndexRune(line, ';') != 0
+}
+
+func SourceHandler(sup *Supervisor, head, tail io.Conn) {
 	started := false
+	fault := sup.Fault()
+	synced := make(chan struct{}, 1)
 
 	readFunc := func() {
 		//TODO: actual N increment testing
-		for msg := range head.Rc() {
+		for msg, ok := head.Read(); ok; msg, ok = head.Read() {
 			str, ok := msg.(string) // only strings
 			if !ok {
 				tail.Write(msg)
 				continue
 			}
 
-			if strings.IndexRune(str, ';') == 0 || str == "" {
+			if !IsAcked(str) {
 				continue // comment-only or blank line
 			}
 
@@ -36,6 +47,15 @@ func SourceHandler(head, tail io.Conn) {
 				tail.Write(g)
 			}
 
+			if g.IsM(400) && err == nil {
+				// ok once the moves before it have run
+				select {
+				case <-synced:
+				case <-sup.Fault():
+				case <-sup.Context().Done():
+				}
+			}
+
 			switch g.Num {
 			case -1:
 				head.Write("ok")
@@ -43,17 +63,47 @@ func SourceHandler(head, tail io.Conn) {
 				head.Write(fmt.Sprintf("ok N%v", g.Num))
 			}
 		}
+		tail.Close()
 	}
 
-	for msg := range tail.Rc() {
-		if str := msg.(string); str == "pages_ready" && !started {
-			head.Write("info:stepd initialized")
+	for {
+		var msg io.Any
+		select {
+		case msg = <-tail.Rc():
+		case <-fault:
+			fault = nil
+			sup.Go(func() {
+				select {
+				case <-sup.Safe():
+					head.Write(sup.Err().String())
+					sup.markDone()
+				case <-sup.Context().Done():
+				}
+			})
+			continue
+		case <-sup.Context().Done():
+			return
+		}
+
+		if io.IsClosed(msg) {
+			head.Close()
+			return
+		} else if _, ok := msg.(Synced); ok {
+			synced <- struct{}{}
+			continue
+		}
+
+		str, ok := msg.(string)
+		if !ok {
+			sup.Fail(newError("source", KindProtocol, "unexpected message %v (%T)", msg, msg))
+			continue
+		} else if str == "pages_ready" && !started {
+			head.Write(Initialized)
 			started = true
-			go readFunc()
-		} else if str := msg.(string); (str == "echo:start" || str == "pages_ready") && started {
-			//TODO: redo this with an appropriate close pattern on the channels
-			fmt.Println("fatal:device restart detected")
-			os.Exit(1)
+			sup.Go(readFunc)
+		} else if (str == "echo:start" || str == "pages_ready") && started {
+			head.Write(DeviceRestart{})
+			return
 		}
 		head.Write(msg)
 	}
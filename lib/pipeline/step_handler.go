@@ -16,9 +16,11 @@ import (
 
 type stepHandler struct {
 	head, tail io.Conn
+	sup        *Supervisor
 
 	spmm           vec.Vec4
 	ticksPerSecond int
+	dwellPages     bool
 	eAdvanceK      float64
 	flowRate       float64
 	zFunc          bed.ZFunc
@@ -26,6 +28,7 @@ type stepHandler struct {
 	sPos [4]int64
 	dir  [4]bool
 	vPos vec.Vec4
+	kin  physics.Kinematics
 
 	formatName       string
 	format           config.PageFormat
@@ -33,16 +36,28 @@ type stepHandler struct {
 
 	currentChunk []byte
 	segmentIdx   int
+
+	shapers [2]physics.InputShaper // X and Y
+	shaper  *physics.ShaperFilter
+
+	advanceWindow     string
+	advanceSmoothTime float64
+	advance           *physics.PressureAdvance
 }
 
 func (h *stepHandler) headRead(msg io.Any) {
 	switch msg := msg.(type) {
 	case gcode.GCode:
+		// pending steps must reach the device first
+		h.drainFilters()
+		h.flushChunk()
 		switch {
 		case msg.IsG(92): // set pos
 			h.updateSPos(msg.Args.GetVec4(h.vPos))
+			h.resetFilters()
 		case msg.IsM(92): // set steps/mm
 			h.spmm = msg.Args.GetVec4(h.spmm)
+			h.updateSPos(h.vPos)
 		case msg.IsM(221): // set flow rate
 			if f, ok := msg.Args.GetFloat('S'); ok {
 				flowRate := f / 100.0
@@ -52,10 +67,20 @@ func (h *stepHandler) headRead(msg io.Any) {
 			if f, ok := msg.Args.GetFloat('K'); ok {
 				h.eAdvanceK = f
 				h.head.Write(fmt.Sprintf("info:setting lin advance k to %v", h.eAdvanceK))
+				h.resetFilters()
 			}
 			return
+		case msg.IsM(593): // set input shaper
+			h.setShaper(msg.Args)
+			return
+		case msg.IsG(4) && h.dwellPages: // dwell
+			h.dwell(msg.Args)
+			return
 		}
 	case physics.MotionBlock:
+		if h.procSegmentBytes == nil {
+			return // bad page format was reported
+		}
 		h.procBlock(msg)
 	case config.Config:
 		h.configUpdate(msg)
@@ -178,6 +203,21 @@ split:
 	return false
 }
 
+// dwell sends idle pages for the dwell time, given in ms (P) or seconds (S).
+func (h *stepHandler) dwell(args gcode.Args) {
+	var secs float64
+	if f, ok := args.GetFloat('P'); ok {
+		secs = f / 1000
+	}
+	if f, ok := args.GetFloat('S'); ok {
+		secs = f
+	}
+	for n := int(math.Round(secs * h.samplesPerSecond())); n > 0; n-- {
+		h.procSegment([4]int{})
+	}
+	h.flushChunk()
+}
+
 func (h *stepHandler) zOffsAt(pos f64.Vec2) float64 {
 	if h.zFunc == nil {
 		return 0
@@ -189,17 +229,17 @@ func (h *stepHandler) zOffsAt(pos f64.Vec2) float64 {
 	return z
 }
 
+// updateSPos moves the motors to the cartesian pos, after adding the
+// bed level offset, and returns the steps taken by each motor.
 func (h *stepHandler) updateSPos(pos vec.Vec4) (ds [4]int) {
+	offs := vec.NewVec4(0, 0, h.zOffsAt(pos.XY()), 0)
+	motors := h.kin.Motors(pos.Add(offs))
 	for i := range ds {
-		offs := 0.0
 		scale := 1.0
-		switch i {
-		case 2:
-			offs = h.zOffsAt(pos.XY())
-		case 3:
+		if i == 3 {
 			scale = h.flowRate
 		}
-		df := (pos.GetAt(i) + offs) * h.spmm.GetAt(i) * scale
+		df := motors.GetAt(i) * h.spmm.GetAt(i) * scale
 		di := int64(math.Round(df))
 		ds[i] = int(di - h.sPos[i])
 		h.sPos[i] = di
@@ -208,26 +248,113 @@ func (h *stepHandler) updateSPos(pos vec.Vec4) (ds [4]int) {
 	return
 }
 
+func (h *stepHandler) samplesPerSecond() float64 {
+	return float64(h.ticksPerSecond) / float64(h.format.SegmentSteps)
+}
+
 func (h *stepHandler) procBlock(block physics.MotionBlock) {
-	samplesPerSecond := float64(h.ticksPerSecond) / float64(h.format.SegmentSteps)
+	move := block.GetMove()
+	isPrint := move.IsPrintMove()
 
 	failed := false
-	for pos := range physics.BlockIterator(block, samplesPerSecond, h.eAdvanceK) {
-		ds := h.updateSPos(pos)
-		failed = !h.procSegment(ds) || failed
+	it := physics.BlockIterator(block, h.samplesPerSecond())
+	for pos, ok := it.Next(); ok; pos, ok = it.Next() {
+		if h.advance != nil {
+			pos = h.advance.Push(pos, isPrint)
+		}
+		failed = !h.procShaped(pos) || failed
 	}
 	if failed {
-		move := block.GetMove()
 		h.head.Write(fmt.Sprintf("warn:segment split with block %v", move.String()))
 	}
 }
 
+// procShaped sends a sampled position through the input shaper.
+func (h *stepHandler) procShaped(pos vec.Vec4) bool {
+	if h.shaper != nil {
+		pos = h.shaper.Push(pos)
+	}
+	return h.procSegment(h.updateSPos(pos))
+}
+
+// drainFilters sends the remaining filtered motion, after the last block.
+func (h *stepHandler) drainFilters() {
+	if h.advance != nil {
+		h.advance.Drain(func(pos vec.Vec4) {
+			h.procShaped(pos)
+		})
+	}
+	if h.shaper != nil {
+		h.shaper.Drain(func(pos vec.Vec4) {
+			h.procSegment(h.updateSPos(pos))
+		})
+	}
+}
+
+// resetFilters rebuilds the filters, starting at the current position.
+func (h *stepHandler) resetFilters() {
+	h.shaper = nil
+	if h.shapers[0].Enabled() || h.shapers[1].Enabled() {
+		h.shaper = physics.NewShaperFilter(h.shapers[0], h.shapers[1], h.samplesPerSecond(), h.vPos)
+	}
+
+	h.advance = nil
+	if h.eAdvanceK != 0 {
+		var err error
+		h.advance, err = physics.NewPressureAdvance(h.eAdvanceK, h.advanceSmoothTime, h.advanceWindow,
+			h.samplesPerSecond(), h.vPos)
+		if err != nil {
+			h.sup.Fail(newError("step", KindConfig, "%v", err))
+		}
+	}
+}
+
+// setShaper updates the input shapers from M593 args. Only the
+// X or Y shaper is changed if the axis is given.
+func (h *stepHandler) setShaper(args gcode.Args) {
+	for i, axis := range "XY" {
+		if (args.Has('X') || args.Has('Y')) && !args.Has(axis) {
+			continue
+		}
+
+		s := h.shapers[i]
+		typ, freq, damping := s.Type, s.Freq, s.Damping
+		if str, ok := args.GetString('T'); ok {
+			typ = str
+		}
+		if f, ok := args.GetFloat('F'); ok {
+			freq = f
+		}
+		if f, ok := args.GetFloat('D'); ok {
+			damping = f
+		}
+
+		s, err := physics.NewInputShaper(typ, freq, damping)
+		if err != nil {
+			h.head.Write(fmt.Sprintf("warn:failed to set input shaper: %v", err))
+			return
+		}
+		h.shapers[i] = s
+		h.head.Write(fmt.Sprintf("info:input shaper for %c is %v", axis, s))
+	}
+	h.resetFilters()
+}
+
 func (h *stepHandler) configUpdate(conf config.Config) {
 	//h.spmm = conf.StepsPerMM
 	h.ticksPerSecond = conf.TicksPerSecond
+	h.dwellPages = conf.DwellPages
 	h.formatName = conf.Format
 	h.format = config.GetPageFormat(h.formatName)
 
+	kin, err := newKinematics(conf)
+	if err != nil {
+		h.sup.Fail(newError("step", KindConfig, "%v", err))
+		return
+	}
+	h.kin = kin
+	h.updateSPos(h.vPos) // motors may not be at 0
+
 	switch h.formatName {
 	case "SP_4x4D_128":
 		h.procSegmentBytes = h.procSegmentBytesSP4x4D128
@@ -236,24 +363,49 @@ func (h *stepHandler) configUpdate(conf config.Config) {
 	case "SP_4x1_512":
 		h.procSegmentBytes = h.procSegmentBytesSP4x1512
 	default:
-		panic("Unknown page format " + h.formatName)
+		h.sup.Fail(newError("step", KindConfig, "unknown page format %v", h.formatName))
+		return
+	}
+
+	switch conf.AdvanceWindow {
+	case "", physics.WindowTriangle, physics.WindowBox:
+		h.advanceWindow = conf.AdvanceWindow
+		h.advanceSmoothTime = conf.AdvanceSmoothTime
+	default:
+		h.sup.Fail(newError("step", KindConfig, "unknown pressure advance window %v", conf.AdvanceWindow))
+		return
+	}
+
+	for i, sc := range [...]config.Shaper{conf.ShaperX, conf.ShaperY} {
+		s, err := physics.NewInputShaper(sc.Type, sc.Freq, sc.Damping)
+		if err != nil {
+			h.sup.Fail(newError("step", KindConfig, "%v", err))
+			return
+		}
+		h.shapers[i] = s
 	}
+	h.resetFilters()
 }
 
-func StepHandler(head, tail io.Conn) {
+func StepHandler(sup *Supervisor, head, tail io.Conn) {
 	h := stepHandler{
-		head: head, tail: tail,
+		head: head, tail: tail, sup: sup,
 
 		flowRate: 1.0,
+		kin:      physics.Cartesian,
 	}
 
-	go func() {
-		for msg := range tail.Rc() {
+	sup.Go(func() {
+		for msg, ok := tail.Read(); ok; msg, ok = tail.Read() {
 			head.Write(msg)
 		}
-	}()
+		head.Close()
+	})
 
-	for msg := range head.Rc() {
+	for msg, ok := head.Read(); ok; msg, ok = head.Read() {
 		h.headRead(msg)
 	}
+	h.drainFilters()
+	h.flushChunk()
+	tail.Close()
 }
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colinrgodsey/step-daemon/lib/io"
+)
+
+// ErrorKind classifies a pipeline Error.
+type ErrorKind string
+
+const (
+	KindConfig          ErrorKind = "config"
+	KindSettingsTimeout ErrorKind = "settings-timeout"
+	KindBedLevel        ErrorKind = "bed-level"
+	KindSyncTimeout     ErrorKind = "sync-timeout"
+	KindMoveLimit       ErrorKind = "move-limit"
+	KindEase            ErrorKind = "ease"
+	KindPageOverflow    ErrorKind = "page-overflow"
+	KindProtocol        ErrorKind = "protocol"
+
+	// safeTimeout is how long the device has to confirm the safe state.
+	safeTimeout = 5 * time.Second
+)
+
+// Error is a fault reported by a handler to the Supervisor.
+type Error struct {
+	Handler string    `json:"handler"`
+	Kind    ErrorKind `json:"kind"`
+	Msg     string    `json:"message"`
+}
+
+func newError(handler string, kind ErrorKind, format string, args ...interface{}) *Error {
+	return &Error{handler, kind, fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.Handler, e.Kind, e.Msg)
+}
+
+// String produces the machine-readable form sent upstream.
+func (e *Error) String() string {
+	b := strings.Builder{}
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+	return "Error:" + strings.TrimSpace(b.String())
+}
+
+// Handler is a single stage of the pipeline.
+type Handler func(sup *Supervisor, head, tail io.Conn)
+
+/*
+Supervisor owns the lifecycle of a pipeline, and collects faults from all
+of its handlers. On the first fault the DeviceHandler puts the device in a
+safe state (quick-stop, heaters off, pending pages discarded), the
+SourceHandler then reports the error upstream, and Done is closed so the
+pipeline can be shut down.
+
+For an orderly shutdown, Close the head of the pipeline. Each handler
+flushes and closes its tail in turn, and once the device has run all
+outstanding pages the close travels back upstream.
+*/
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err *Error
+
+	fault, safe, done  chan struct{}
+	safeOnce, doneOnce sync.Once
+}
+
+func NewSupervisor(ctx context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Supervisor{
+		ctx:    ctx,
+		cancel: cancel,
+		fault:  make(chan struct{}),
+		safe:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs h as the next stage after head, and returns the
+// tail Conn to use as the head of the following stage.
+func (s *Supervisor) Start(head io.Conn, size int, h Handler) (tail io.Conn) {
+	head = head.Flip().WithContext(s.ctx)
+	tail = io.NewConn(size, size).WithContext(s.ctx)
+
+	s.Go(func() { h(s, head, tail) })
+
+	return
+}
+
+// Go runs f in a goroutine tracked by Wait.
+func (s *Supervisor) Go(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// Context is cancelled when the pipeline is stopped.
+func (s *Supervisor) Context() context.Context {
+	return s.ctx
+}
+
+// Stop cancels the pipeline immediately.
+func (s *Supervisor) Stop() {
+	s.cancel()
+}
+
+// Wait for all handler goroutines to exit.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Fail reports a fault. Only the first fault is acted on.
+func (s *Supervisor) Fail(err *Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.fault)
+
+	go func() {
+		select {
+		case <-time.After(safeTimeout):
+			s.markSafe()
+		case <-s.safe:
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+// Err returns the first fault, or nil.
+func (s *Supervisor) Err() *Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Fault is closed when the first fault is reported.
+func (s *Supervisor) Fault() <-chan struct{} {
+	return s.fault
+}
+
+// Safe is closed once the device is in a safe state, or has failed
+// to confirm it in time.
+func (s *Supervisor) Safe() <-chan struct{} {
+	return s.safe
+}
+
+// Done is closed once the fault has been handled and reported upstream.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Supervisor) markSafe() {
+	s.safeOnce.Do(func() { close(s.safe) })
+}
+
+func (s *Supervisor) markDone() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
@@ -0,0 +1,342 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	gio "io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colinrgodsey/step-daemon/lib/config"
+	"github.com/colinrgodsey/step-daemon/lib/gcode"
+	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+const (
+	pFree = 0
+	pOk   = 2
+	pFail = 3
+
+	// numPages must match the page count used by the host.
+	numPages = 16
+
+	// outQueueSize stands in for the serial buffers of a real device.
+	outQueueSize = 1024
+)
+
+// Device is a virtual DIRECT_STEPPING Marlin device. It implements
+// io.ReadWriteCloser, and is meant to be used as the device end of
+// io.LinePipe in place of a serial port.
+type Device struct {
+	inR  *gio.PipeReader
+	inW  *gio.PipeWriter
+	outR *gio.PipeReader
+	outW *gio.PipeWriter
+	out  chan []byte
+
+	formatName string
+	format     config.PageFormat
+	realtime   bool
+
+	mu       sync.Mutex
+	settings Settings
+	pages    [numPages][]byte
+	states   [numPages]byte
+	dirs     [4]bool
+	counts   [4]int64
+	offset   vec.Vec4
+	pagesRun int
+}
+
+// NewDevice creates and starts a virtual device using the named page
+// format. If realtime is set, pages take as long to run as they would
+// on a real device, otherwise they are executed immediately.
+func NewDevice(format string, settings Settings, realtime bool) *Device {
+	d := &Device{
+		formatName: format,
+		format:     config.GetPageFormat(format),
+		realtime:   realtime,
+		settings:   settings,
+		out:        make(chan []byte, outQueueSize),
+	}
+	d.inR, d.inW = gio.Pipe()
+	d.outR, d.outW = gio.Pipe()
+
+	go d.run()
+	go d.writeOut()
+
+	return d
+}
+
+// Read output from the device.
+func (d *Device) Read(p []byte) (int, error) {
+	return d.outR.Read(p)
+}
+
+// Write input to the device.
+func (d *Device) Write(p []byte) (int, error) {
+	return d.inW.Write(p)
+}
+
+// Close shuts down the device.
+func (d *Device) Close() error {
+	d.inW.Close()
+	return d.outR.Close()
+}
+
+// Position returns the current logical position of the device. Positions
+// are derived from the step counts, so only cartesian machines are supported.
+func (d *Device) Position() vec.Vec4 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.position()
+}
+
+// Counts returns the current stepper counts of the device.
+func (d *Device) Counts() [4]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.counts
+}
+
+// PagesRun returns the number of pages executed with G6.
+func (d *Device) PagesRun() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pagesRun
+}
+
+func (d *Device) run() {
+	defer close(d.out)
+
+	d.writeLine("start")
+	d.writeLine("pages_ready")
+
+	reader := bufio.NewReader(d.inR)
+	for {
+		b, err := reader.ReadByte()
+		switch {
+		case err != nil:
+			return
+		case b == io.ControlChar:
+			if err := d.readPage(reader); err != nil {
+				return
+			}
+		case b == '\n' || b == '\r':
+		default:
+			reader.UnreadByte()
+			str, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			d.procLine(strings.TrimSpace(str))
+		}
+	}
+}
+
+// readPage reads page data in the format: idx, size, data..., checksum
+func (d *Device) readPage(reader *bufio.Reader) error {
+	header := make([]byte, 2)
+	if _, err := gio.ReadFull(reader, header); err != nil {
+		return err
+	}
+	idx, sz := int(header[0]), int(header[1])
+	if sz == 0 {
+		sz = 256
+	}
+	data := make([]byte, sz+1)
+	if _, err := gio.ReadFull(reader, data); err != nil {
+		return err
+	}
+	data, chs := data[:sz], data[sz]
+	for _, b := range data {
+		chs ^= b
+	}
+
+	d.mu.Lock()
+	switch {
+	case idx >= numPages:
+		d.mu.Unlock()
+		d.writeLine(fmt.Sprintf("Error:bad page index %v", idx))
+		return nil
+	case chs != 0:
+		d.states[idx] = pFail
+	default:
+		d.pages[idx] = data
+		d.states[idx] = pOk
+	}
+	d.mu.Unlock()
+
+	d.reportStates()
+	return nil
+}
+
+func (d *Device) procLine(str string) {
+	g, err := gcode.Parse(str)
+	if err != nil {
+		d.writeLine(fmt.Sprintf("Error:%v", err))
+		d.writeLine("ok")
+		return
+	}
+
+	switch {
+	case g.IsG(6):
+		d.runPage(g)
+	case g.IsG(28):
+		d.mu.Lock()
+		d.counts = [4]int64{}
+		d.offset = vec.Vec4{}
+		d.mu.Unlock()
+	case g.IsG(92):
+		d.mu.Lock()
+		pos := d.position()
+		d.offset = d.offset.Add(g.Args.GetVec4(pos).Sub(pos))
+		d.mu.Unlock()
+	case g.IsM(114):
+		d.writeLine(d.positionReport())
+	case g.IsM(503):
+		d.mu.Lock()
+		lines := d.settings.Report()
+		d.mu.Unlock()
+		for _, line := range lines {
+			d.writeLine(line)
+		}
+	default:
+		d.mu.Lock()
+		d.settings.update(g)
+		d.mu.Unlock()
+	}
+	d.writeLine("ok")
+}
+
+func (d *Device) runPage(g gcode.GCode) {
+	ba := func(a rune, x *bool) {
+		if i, ok := g.Args.GetInt(a); ok {
+			*x = i != 0
+		}
+	}
+
+	idx, ok := g.Args.GetInt('I')
+	if !ok || idx < 0 || idx >= numPages {
+		d.writeLine("Error:G6 missing valid page index")
+		return
+	}
+	steps, ok := g.Args.GetInt('S')
+	if !ok {
+		steps = d.format.Segments * d.format.SegmentSteps
+	}
+	rate, _ := g.Args.GetInt('R')
+
+	d.mu.Lock()
+	ba('X', &d.dirs[0])
+	ba('Y', &d.dirs[1])
+	ba('Z', &d.dirs[2])
+	ba('E', &d.dirs[3])
+
+	if d.states[idx] != pOk {
+		d.mu.Unlock()
+		d.writeLine(fmt.Sprintf("Error:page %v is not ready", idx))
+		return
+	}
+	page := d.pages[idx]
+	for i := 0; i < steps/d.format.SegmentSteps; i++ {
+		d.stepSegment(page, i)
+	}
+	d.pages[idx] = nil
+	d.states[idx] = pFree
+	d.pagesRun++
+	d.mu.Unlock()
+
+	if d.realtime && rate > 0 {
+		time.Sleep(time.Duration(steps) * time.Second / time.Duration(rate))
+	}
+	d.reportStates()
+}
+
+func (d *Device) stepSegment(page []byte, i int) {
+	var ds [4]int
+	switch d.formatName {
+	case "SP_4x4D_128":
+		a, b := page[i*2], page[i*2+1]
+		ds[0] = int(a>>4) - 7
+		ds[1] = int(a&0xF) - 7
+		ds[2] = int(b>>4) - 7
+		ds[3] = int(b&0xF) - 7
+	case "SP_4x2_256":
+		for a := range ds {
+			ds[a] = int(page[i]>>uint((3-a)*2)) & 0x3
+		}
+	case "SP_4x1_512":
+		nibble := page[i/2]
+		if i&1 == 1 {
+			nibble >>= 4
+		}
+		for a := range ds {
+			ds[a] = int(nibble>>uint(3-a)) & 0x1
+		}
+	}
+	for a, s := range ds {
+		if !d.format.Directional && !d.dirs[a] {
+			s = -s
+		}
+		d.counts[a] += int64(s)
+	}
+}
+
+func (d *Device) position() vec.Vec4 {
+	var pos [4]float64
+	for i, c := range d.counts {
+		if spmm := d.settings.StepsPerMM.GetAt(i); spmm != 0 {
+			pos[i] = float64(c) / spmm
+		}
+	}
+	return vec.NewVec4(pos[:]...).Add(d.offset)
+}
+
+func (d *Device) positionReport() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	x, y, z, e := d.position().Get()
+	return fmt.Sprintf("X:%.2f Y:%.2f Z:%.2f E:%.2f Count X:%v Y:%v Z:%v",
+		x, y, z, e, d.counts[0], d.counts[1], d.counts[2])
+}
+
+// reportStates sends the page states in the 5-byte binary control format.
+func (d *Device) reportStates() {
+	msg := make([]byte, 0, io.ControlLineLength+1)
+	msg = append(msg, io.ControlChar)
+
+	var dat [io.ControlLineLength - 1]byte
+	d.mu.Lock()
+	for i, s := range d.states {
+		dat[i/4] |= s << uint((i*2)%8)
+	}
+	d.mu.Unlock()
+
+	var chs byte
+	for _, b := range dat {
+		chs ^= b
+	}
+	msg = append(msg, dat[:]...)
+	msg = append(msg, chs)
+	d.out <- msg
+}
+
+func (d *Device) writeLine(str string) {
+	d.out <- []byte(str + "\n")
+}
+
+func (d *Device) writeOut() {
+	defer d.outW.Close()
+	for msg := range d.out {
+		if _, err := d.outW.Write(msg); err != nil {
+			d.inR.CloseWithError(err)
+			break
+		}
+	}
+	for range d.out {
+		// drain until run exits
+	}
+}
@@ -0,0 +1,112 @@
+package sim
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/colinrgodsey/step-daemon/lib/gcode"
+	"github.com/colinrgodsey/step-daemon/lib/io"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+func readUntil(t *testing.T, c io.Conn, pred func(msg io.Any) bool) {
+	timer := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timer:
+			t.Fatal("timed out")
+		case msg := <-c.Rc():
+			if pred(msg) {
+				return
+			}
+		}
+	}
+}
+
+func isLine(str string) func(io.Any) bool {
+	return func(msg io.Any) bool {
+		s, ok := msg.(string)
+		return ok && strings.Index(s, str) == 0
+	}
+}
+
+func TestSettings(t *testing.T) {
+	d := NewDevice("SP_4x2_256", DefaultSettings, false)
+	defer d.Close()
+
+	c := io.NewConn(32, 32)
+	go io.LinePipe(d, d, c)
+
+	readUntil(t, c, isLine("pages_ready"))
+	c.Write(gcode.New('M', 503).String())
+	readUntil(t, c, isLine("echo:  M92 X80.00"))
+	readUntil(t, c, isLine("echo:; Advanced:"))
+	readUntil(t, c, isLine("echo:  M207 S3.00 W13.00 F2700.00 Z0.00"))
+	readUntil(t, c, isLine("ok"))
+
+	c.Write(gcode.New('M', 209, "S1").String())
+	readUntil(t, c, isLine("ok"))
+	c.Write(gcode.New('M', 503).String())
+	readUntil(t, c, isLine("echo:  M209 S1"))
+}
+
+func TestLoadSettings(t *testing.T) {
+	f, err := ioutil.TempFile("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("echo:; Steps per unit:\necho:  M92 X100.00 Y100.00\nM203 Z5\nok\n")
+	f.Close()
+
+	s, err := LoadSettings(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.StepsPerMM != vec.NewVec4(100, 100, 1600, 376.14) || s.MaxFeedrate.Z() != 5 {
+		t.Fatalf("Unexpected settings %v", s)
+	}
+	if s.MaxAccel != DefaultSettings.MaxAccel {
+		t.Fatalf("Defaults should be kept, got %v", s.MaxAccel)
+	}
+}
+
+func TestPages(t *testing.T) {
+	d := NewDevice("SP_4x2_256", DefaultSettings, false)
+	defer d.Close()
+
+	c := io.NewConn(32, 32)
+	go io.LinePipe(d, d, c)
+	readUntil(t, c, isLine("pages_ready"))
+
+	// 10 segments of 3 positive X steps, 1 negative Y step
+	data := make([]byte, 10)
+	var chs byte
+	for i := range data {
+		data[i] = 3<<6 | 1<<4
+		chs ^= data[i]
+	}
+	page := append([]byte{4, byte(len(data))}, data...)
+	c.Write(append(page, chs))
+
+	readUntil(t, c, func(msg io.Any) bool {
+		b, ok := msg.([]byte)
+		return ok && b[1]&3 == pOk
+	})
+
+	c.Write(gcode.New('G', 6, "I4", "S30", "R61440", "X1", "Y0").String())
+	readUntil(t, c, isLine("ok"))
+
+	if counts := d.Counts(); counts[0] != 30 || counts[1] != -10 {
+		t.Fatalf("Bad step counts after page: %v", counts)
+	}
+	if d.PagesRun() != 1 {
+		t.Fatalf("Page was not run")
+	}
+
+	c.Write(gcode.New('M', 114).String())
+	readUntil(t, c, isLine("X:0.38 Y:-0.12 Z:0.00 E:0.00 Count X:30 Y:-10 Z:0"))
+}
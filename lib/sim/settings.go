@@ -0,0 +1,144 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/colinrgodsey/step-daemon/lib/gcode"
+	"github.com/colinrgodsey/step-daemon/lib/vec"
+)
+
+// Settings are the motion settings reported by the virtual device for M503.
+type Settings struct {
+	StepsPerMM  vec.Vec4 // M92
+	MaxFeedrate vec.Vec4 // M203
+	MaxAccel    vec.Vec4 // M201
+
+	PrintAccel, RetractAccel, TravelAccel float64 // M204
+
+	JunctionDeviation float64 // M205 J
+
+	// firmware retraction lengths (mm) and feedrates (mm/min)
+	RetractLength, RetractSwapLength, RetractFeedrate, RetractZHop float64 // M207
+	RecoverExtra, RecoverSwapExtra, RecoverFeedrate                float64 // M208
+	AutoRetract                                                    bool    // M209
+}
+
+// DefaultSettings are the settings of a typical 8-bit cartesian printer.
+var DefaultSettings = Settings{
+	StepsPerMM:  vec.NewVec4(80, 80, 1600, 376.14),
+	MaxFeedrate: vec.NewVec4(300, 300, 7, 50),
+	MaxAccel:    vec.NewVec4(2000, 1200, 100, 1000),
+
+	PrintAccel:   1000,
+	RetractAccel: 2000,
+	TravelAccel:  3000,
+
+	JunctionDeviation: 0.013,
+
+	RetractLength:     3,
+	RetractSwapLength: 13,
+	RetractFeedrate:   2700,
+	RecoverFeedrate:   480,
+}
+
+func (s *Settings) update(g gcode.GCode) {
+	switch {
+	case g.IsM(92):
+		s.StepsPerMM = g.Args.GetVec4(s.StepsPerMM)
+	case g.IsM(201):
+		s.MaxAccel = g.Args.GetVec4(s.MaxAccel)
+	case g.IsM(203):
+		s.MaxFeedrate = g.Args.GetVec4(s.MaxFeedrate)
+	case g.IsM(204):
+		if f, ok := g.Args.GetFloat('P'); ok {
+			s.PrintAccel = f
+		}
+		if f, ok := g.Args.GetFloat('R'); ok {
+			s.RetractAccel = f
+		}
+		if f, ok := g.Args.GetFloat('T'); ok {
+			s.TravelAccel = f
+		}
+	case g.IsM(205):
+		if f, ok := g.Args.GetFloat('J'); ok {
+			s.JunctionDeviation = f
+		}
+	case g.IsM(207):
+		getFloats(g.Args, map[rune]*float64{'S': &s.RetractLength, 'W': &s.RetractSwapLength,
+			'F': &s.RetractFeedrate, 'Z': &s.RetractZHop})
+	case g.IsM(208):
+		getFloats(g.Args, map[rune]*float64{'S': &s.RecoverExtra, 'W': &s.RecoverSwapExtra,
+			'F': &s.RecoverFeedrate})
+	case g.IsM(209):
+		if i, ok := g.Args.GetInt('S'); ok {
+			s.AutoRetract = i != 0
+		}
+	}
+}
+
+// getFloats sets each float to its arg, if given.
+func getFloats(args gcode.Args, fs map[rune]*float64) {
+	for a, f := range fs {
+		if x, ok := args.GetFloat(a); ok {
+			*f = x
+		}
+	}
+}
+
+// LoadSettings reads a settings profile on top of DefaultSettings. The
+// profile is a list of settings commands (M92, M201, M203, M204, M205, M207-M209),
+// such as the saved M503 response of a device. Other lines are ignored.
+func LoadSettings(path string) (Settings, error) {
+	s := DefaultSettings
+	f, err := os.Open(path)
+	if err != nil {
+		return s, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "echo:"))
+		if g, err := gcode.Parse(line); err == nil {
+			s.update(g)
+		}
+	}
+	return s, scanner.Err()
+}
+
+// Report produces the M503 response lines, in the same format Marlin uses.
+func (s *Settings) Report() []string {
+	v4 := func(code int, v vec.Vec4) string {
+		return fmt.Sprintf("echo:  M%v X%.2f Y%.2f Z%.2f E%.2f",
+			code, v.X(), v.Y(), v.Z(), v.E())
+	}
+
+	autoRetract := 0
+	if s.AutoRetract {
+		autoRetract = 1
+	}
+
+	return []string{
+		"echo:  G21    ; Units in mm (mm)",
+		"echo:; Steps per unit:",
+		v4(92, s.StepsPerMM),
+		"echo:; Maximum feedrates (units/s):",
+		v4(203, s.MaxFeedrate),
+		"echo:; Maximum Acceleration (units/s2):",
+		v4(201, s.MaxAccel),
+		"echo:; Acceleration (units/s2): P<print_accel> R<retract_accel> T<travel_accel>",
+		fmt.Sprintf("echo:  M204 P%.2f R%.2f T%.2f", s.PrintAccel, s.RetractAccel, s.TravelAccel),
+		"echo:; Advanced: B<min_segment_time_us> S<min_feedrate> T<min_travel_feedrate> J<junc_dev>",
+		fmt.Sprintf("echo:  M205 B20000.00 S0.00 T0.00 J%.3f", s.JunctionDeviation),
+		"echo:; Retract: S<length> F<units/m> Z<lift>",
+		fmt.Sprintf("echo:  M207 S%.2f W%.2f F%.2f Z%.2f",
+			s.RetractLength, s.RetractSwapLength, s.RetractFeedrate, s.RetractZHop),
+		"echo:; Recover: S<length> F<units/m>",
+		fmt.Sprintf("echo:  M208 S%.2f W%.2f F%.2f", s.RecoverExtra, s.RecoverSwapExtra, s.RecoverFeedrate),
+		"echo:; Auto-Retract: S=0 to disable, 1 to interpret E-only moves as retract/recover",
+		fmt.Sprintf("echo:  M209 S%v", autoRetract),
+	}
+}